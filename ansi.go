@@ -1,154 +1,451 @@
 package main
 
-var drawColor ANSIData = ANSI_DEFAULT
+import (
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+var trueColor = true
 
 type ANSIData struct {
 	Red   uint8
 	Green uint8
 	Blue  uint8
 
-	Style uint8
+	Style  uint8
+	Weight uint8 //Bold or dim
+	Index  int16 //Palette index the color came from, ANSI_NO_INDEX or ANSI_DIRECT_INDEX if none
+
+	//Background, only drawn if BgIndex is not ANSI_NO_INDEX
+	BgRed   uint8
+	BgGreen uint8
+	BgBlue  uint8
+	BgIndex int16
 }
 
-const ANSI_STYLE_RESET = 0
-const ANSI_STYLE_ITALIC = 1
-const ANSI_STYLE_UNDERLINE = 2
-const ANSI_STYLE_INVERSE = 3
-const ANSI_STYLE_STRIKE = 4
-const ANSI_STYLE_ERROR = 5
-const ANSI_STYLE_CONTROL = 6
+const ANSI_NO_INDEX = -1
+const ANSI_DIRECT_INDEX = -2 //24-bit color, RGB is used as-is
+
+const ANSI_WEIGHT_NORMAL = 0
+const ANSI_WEIGHT_BOLD = 1
+const ANSI_WEIGHT_DIM = 2
+
+const MAX_CSI_LENGTH = 64   //Longest escape sequence we will look for
+const MAX_ESC_STRING = 4096 //Longest OSC/DCS string, ex: a window title
+
+//Styles are bits, so they can be combined
+const ANSI_STYLE_ITALIC = 1 << 0
+const ANSI_STYLE_UNDERLINE = 1 << 1
+const ANSI_STYLE_INVERSE = 1 << 2
+const ANSI_STYLE_STRIKE = 1 << 3
+const ANSI_STYLE_BLINK = 1 << 4
+const ANSI_STYLE_CONTROL = 1 << 7
 
 var ANSI_CONTROL = ANSIData{Style: ANSI_STYLE_CONTROL, Red: 0xAA}
-var ANSI_RESET = ANSIData{Style: ANSI_STYLE_RESET, Red: 0xFF, Green: 0xFF, Blue: 0xFF}
-var ANSI_ITALIC = ANSIData{Style: ANSI_STYLE_ITALIC}
-var ANSI_UNDERLINE = ANSIData{Style: ANSI_STYLE_UNDERLINE}
-var ANSI_INVERSE = ANSIData{Style: ANSI_STYLE_INVERSE}
-var ANSI_STRIKE = ANSIData{Style: ANSI_STYLE_STRIKE}
-var ANSI_ERROR = ANSIData{Style: ANSI_STYLE_ERROR, Red: 0xFF}
-
-var ANSI_DEFAULT = ANSIData{Red: 0xFF, Green: 0xFF, Blue: 0xFF}
-var ANSI_BLACK = ANSIData{Red: 0x00, Green: 0x00, Blue: 0x00}
-var ANSI_RED = ANSIData{Red: 0x7F}
-var ANSI_GREEN = ANSIData{Green: 0x7F}
-var ANSI_YELLOW = ANSIData{Red: 0x7F, Green: 0x7F}
-var ANSI_BLUE = ANSIData{Blue: 0x7F}
-var ANSI_MAGENTA = ANSIData{Red: 0x7F, Blue: 0x7F}
-var ANSI_CYAN = ANSIData{Green: 0x7F, Blue: 0x7F}
-var ANSI_GRAY = ANSIData{Red: 0xAA, Green: 0xAA, Blue: 0xAA}
-
-var ANSI_LGRAY = ANSIData{Red: 0x7F, Green: 0x7F, Blue: 0x7F}
-var ANSI_LRED = ANSIData{Red: 0xFF}
-var ANSI_LGREEN = ANSIData{Green: 0xFF}
-var ANSI_LYELLOW = ANSIData{Red: 0xFF, Green: 0xFF}
-var ANSI_LBLUE = ANSIData{Blue: 0xFF}
-var ANSI_LMAGENTA = ANSIData{Red: 0xFF, Blue: 0xFF}
-var ANSI_LCYAN = ANSIData{Green: 0xFF, Blue: 0xFF}
-var ANSI_WHITE = ANSIData{Red: 0xFF, Green: 0xFF, Blue: 0xFF}
-
-func DecodeANSI(c string) ANSIData {
-
-	if c == "\033[0m" {
-		return ANSI_RESET
-	} else if c == "\033[0;3m" {
-		return ANSI_ITALIC
-	} else if c == "\033[0;4m" {
-		return ANSI_UNDERLINE
-	} else if c == "\033[0;7m" {
-		return ANSI_INVERSE
-	} else if c == "\033[0;9m" {
-		return ANSI_STRIKE
-
-	} else if c == "\033[0;30m" {
-		return ANSI_BLACK
-	} else if c == "\033[0;31m" {
-		return ANSI_RED
-	} else if c == "\033[0;32m" {
-		return ANSI_GREEN
-	} else if c == "\033[0;33m" {
-		return ANSI_YELLOW
-	} else if c == "\033[0;34m" {
-		return ANSI_BLUE
-	} else if c == "\033[0;35m" {
-		return ANSI_MAGENTA
-	} else if c == "\033[0;36m" {
-		return ANSI_CYAN
-	} else if c == "\033[0;37m" {
-		return ANSI_GRAY
-
-	} else if c == "\033[1;30m" {
-		return ANSI_LGRAY
-	} else if c == "\033[1;31m" {
-		return ANSI_LRED
-	} else if c == "\033[1;32m" {
-		return ANSI_LGREEN
-	} else if c == "\033[1;33m" {
-		return ANSI_LYELLOW
-	} else if c == "\033[1;34m" {
-		return ANSI_LBLUE
-	} else if c == "\033[1;35m" {
-		return ANSI_LMAGENTA
-	} else if c == "\033[1;36m" {
-		return ANSI_LCYAN
-	} else if c == "\033[1;37m" {
-		return ANSI_WHITE
-	}
-
-	return ANSI_ERROR
+
+var ANSI_DEFAULT = ANSIData{Red: 0xFF, Green: 0xFF, Blue: 0xFF, Index: ANSI_NO_INDEX, BgIndex: ANSI_NO_INDEX}
+
+func init() {
+	RegisterSetting(&Setting{
+		Name: "truecolor",
+		Help: "Show 24-bit colors as sent, off maps them to the 16 basic colors",
+		Get:  func() string { return FormatBool(trueColor) },
+		Set: func(val string) error {
+			if err := SetBool(&trueColor, val); err != nil {
+				return err
+			}
+			//24-bit colors are mapped when drawing, the stored colors stay as sent
+			MainWin.lines.ClearImages()
+			MainWin.viewChanged = true
+			return nil
+		},
+	})
 }
 
-func StripANSI(c string) string {
+//DrawColor is the color to draw with, dim is applied here,
+//and 24-bit colors are mapped to the palette when truecolor is off
+func (c ANSIData) DrawColor() color.RGBA {
+	if c.Index == ANSI_DIRECT_INDEX && !trueColor {
+		p := ActiveColors().Palette[NearestPalette(c)]
+		c.Red, c.Green, c.Blue = p.Red, p.Green, p.Blue
+	}
+	if c.Weight == ANSI_WEIGHT_DIM {
+		return color.RGBA{c.Red / 2, c.Green / 2, c.Blue / 2, 0xFF}
+	}
+	return color.RGBA{c.Red, c.Green, c.Blue, 0xFF}
+}
+
+//BackColor is the cell background, false if there is none
+func (c ANSIData) BackColor() (color.RGBA, bool) {
+	if c.BgIndex == ANSI_NO_INDEX {
+		return color.RGBA{}, false
+	}
+	if c.BgIndex == ANSI_DIRECT_INDEX && !trueColor {
+		p := ActiveColors().Palette[NearestPalette(ANSIData{Red: c.BgRed, Green: c.BgGreen, Blue: c.BgBlue})]
+		return color.RGBA{p.Red, p.Green, p.Blue, 0xFF}, true
+	}
+	return color.RGBA{c.BgRed, c.BgGreen, c.BgBlue, 0xFF}, true
+}
 
-	foundColor := false
-	startColor := 0
-	endColor := 0
+//parseSGR splits SGR parameters on ';', and each of those on ':' for
+//the colon form of extended colors. Empty parameters count as 0.
+func parseSGR(params string) ([][]int, bool) {
+	if params == "" {
+		return [][]int{{0}}, true
+	}
 
-	slen := len(c)
-	for z := 0; z < slen; z++ {
-		if c[z] == '\033' {
-			foundColor = true
-			startColor = z
-		} else if foundColor && c[z] == 'm' {
-			endColor = z
-			c = c[0:startColor-1] + c[endColor+1:]
-			slen = len(c)
+	parts := strings.Split(params, ";")
+	groups := make([][]int, len(parts))
+	for i, part := range parts {
+		subs := strings.Split(part, ":")
+		groups[i] = make([]int, len(subs))
+		for k, sub := range subs {
+			if sub == "" {
+				continue
+			}
+			n, err := strconv.Atoi(sub)
+			if err != nil || n < 0 {
+				return nil, false
+			}
+			groups[i][k] = n
 		}
 	}
-	return c
+	return groups, true
 }
 
-func AnsiColor(t string) []ANSIData {
-	textLen := len(t)
-	foundColor := false //Mark when color code starts
-	colorStart := 0     //Color code start position
-	colorEnd := 0       //Color code end position
+//ApplySGR applies the parameters of an SGR sequence (the part between "\033[" and "m")
+func ApplySGR(cur ANSIData, params string) ANSIData {
+	groups, ok := parseSGR(params)
+	if !ok {
+		return cur
+	}
 
-	//Only alloc what we need
-	textColors := make([]ANSIData, textLen+1)
+	for i := 0; i < len(groups); i++ {
+		n := groups[i][0]
+		switch {
+		case n == 0:
+			cur = ANSI_DEFAULT
+		case n == 1:
+			cur.Weight = ANSI_WEIGHT_BOLD
+		case n == 2:
+			cur.Weight = ANSI_WEIGHT_DIM
+		case n == 22:
+			cur.Weight = ANSI_WEIGHT_NORMAL
 
-	for z := 0; z < textLen; z++ {
-		if t[z] == '\033' {
-			foundColor = true            //Found ANSI escape code
-			colorStart = z               //Record start pos
-			textColors[z] = ANSI_CONTROL //Mark this as no-draw
-			continue
-		} else if z-colorStart > 10 { //Bail, this isn't a valid color code
-			foundColor = false
-		} else if foundColor && t[z] == 'm' { //Color code end
-			colorEnd = z
-			foundColor = false
-			if z+1 < textLen { //Make sure we dont run off the end of the string
-				//Use global, so colors can persist between liness
-				drawColor = DecodeANSI(t[colorStart : colorEnd+1])
-				textColors[z+1] = drawColor //Set color
+		case n == 3:
+			cur.Style |= ANSI_STYLE_ITALIC
+		case n == 4 || n == 21: //21 is double underline
+			cur.Style |= ANSI_STYLE_UNDERLINE
+		case n == 5 || n == 6:
+			cur.Style |= ANSI_STYLE_BLINK
+		case n == 7:
+			cur.Style |= ANSI_STYLE_INVERSE
+		case n == 9:
+			cur.Style |= ANSI_STYLE_STRIKE
+		case n == 23:
+			cur.Style &^= ANSI_STYLE_ITALIC
+		case n == 24:
+			cur.Style &^= ANSI_STYLE_UNDERLINE
+		case n == 25:
+			cur.Style &^= ANSI_STYLE_BLINK
+		case n == 27:
+			cur.Style &^= ANSI_STYLE_INVERSE
+		case n == 29:
+			cur.Style &^= ANSI_STYLE_STRIKE
+
+		case n >= 30 && n <= 37:
+			cur.Index = int16(n - 30)
+		case n == 39:
+			cur.Index = ANSI_NO_INDEX
+		case n >= 90 && n <= 97:
+			cur.Index = int16(n - 90 + 8)
+
+		case n >= 40 && n <= 47:
+			cur.BgIndex = int16(n - 40)
+		case n == 49:
+			cur.BgIndex = ANSI_NO_INDEX
+		case n >= 100 && n <= 107:
+			cur.BgIndex = int16(n - 100 + 8)
+
+		case n == 38 || n == 48:
+			var args []int
+			if len(groups[i]) > 1 {
+				//38:5:n or 38:2:[colorspace]:r:g:b
+				args = groups[i][1:]
+				if len(args) >= 5 && args[0] == 2 {
+					args = []int{2, args[2], args[3], args[4]}
+				}
+			} else {
+				//38;5;n or 38;2;r;g;b
+				for _, g := range groups[i+1:] {
+					args = append(args, g[0])
+				}
+			}
+
+			col, used, ok := extendedColor(args)
+			if len(groups[i]) == 1 {
+				i += used
 			}
-			textColors[z] = ANSI_CONTROL //Mark code end as so
+			if n == 38 && ok {
+				cur.Index = col.Index
+				cur.Red, cur.Green, cur.Blue = col.Red, col.Green, col.Blue
+			} else if n == 48 && ok {
+				cur.BgIndex = col.Index
+				cur.BgRed, cur.BgGreen, cur.BgBlue = col.Red, col.Green, col.Blue
+			}
+		}
+	}
+	return resolveColor(cur)
+}
+
+//extendedColor reads the arguments of 38/48 (5;n or 2;r;g;b),
+//returns the color, how many arguments were used, and if it was valid
+func extendedColor(args []int) (ANSIData, int, bool) {
+	if len(args) == 0 {
+		return ANSI_DEFAULT, 0, false
+	}
+	switch args[0] {
+	case 5:
+		if len(args) < 2 {
+			return ANSI_DEFAULT, len(args), false
+		}
+		if args[1] > 255 {
+			return ANSI_DEFAULT, 2, false
+		}
+		return ANSIData{Index: int16(args[1])}, 2, true
+	case 2:
+		if len(args) < 4 {
+			return ANSI_DEFAULT, len(args), false
+		}
+		if args[1] > 255 || args[2] > 255 || args[3] > 255 {
+			return ANSI_DEFAULT, 4, false
+		}
+		return ANSIData{Red: uint8(args[1]), Green: uint8(args[2]), Blue: uint8(args[3]), Index: ANSI_DIRECT_INDEX}, 4, true
+	}
+	return ANSI_DEFAULT, 1, false
+}
+
+//resolveColor sets the RGB values from the palette indexes and weight.
+//Dim is applied when drawing, so direct colors are never halved twice.
+func resolveColor(cur ANSIData) ANSIData {
+	if cur.Index != ANSI_DIRECT_INDEX {
+		rgb := ActiveColors().FG
+		if cur.Index != ANSI_NO_INDEX {
+			idx := int(cur.Index)
+			//Bold makes the 8 basic colors bright, like most terminals
+			if idx < 8 && cur.Weight == ANSI_WEIGHT_BOLD {
+				idx += 8
+			}
+			rgb = Palette256(idx)
+		}
+		cur.Red, cur.Green, cur.Blue = rgb.Red, rgb.Green, rgb.Blue
+	}
+
+	//Bold does not brighten backgrounds
+	if cur.BgIndex >= 0 {
+		rgb := Palette256(int(cur.BgIndex))
+		cur.BgRed, cur.BgGreen, cur.BgBlue = rgb.Red, rgb.Green, rgb.Blue
+	} else if cur.BgIndex == ANSI_NO_INDEX {
+		cur.BgRed, cur.BgGreen, cur.BgBlue = 0, 0, 0
+	}
+	return cur
+}
+
+//NearestPalette finds the closest of the 16 theme colors, for when truecolor is off
+func NearestPalette(c ANSIData) int {
+	best := 0
+	bestDist := -1
+	for i, p := range ActiveColors().Palette {
+		dr := int(c.Red) - int(p.Red)
+		dg := int(c.Green) - int(p.Green)
+		db := int(c.Blue) - int(p.Blue)
+		//Weighted for how bright each channel looks
+		dist := dr*dr*3 + dg*dg*4 + db*db*2
+		if bestDist < 0 || dist < bestDist {
+			best = i
+			bestDist = dist
+		}
+	}
+	return best
+}
+
+//Palette256 returns an xterm 256 color palette entry
+func Palette256(n int) ANSIData {
+	if n < 0 || n > 255 {
+		return ANSI_DEFAULT
+	}
+	if n < 16 {
+		return ActiveColors().Palette[n]
+	}
+
+	//Grayscale ramp
+	if n >= 232 {
+		v := uint8(8 + (n-232)*10)
+		return ANSIData{Red: v, Green: v, Blue: v}
+	}
+
+	//6x6x6 color cube
+	n -= 16
+	level := func(v int) uint8 {
+		if v == 0 {
+			return 0
+		}
+		return uint8(55 + v*40)
+	}
+	return ANSIData{Red: level(n / 36), Green: level((n / 6) % 6), Blue: level(n % 6)}
+}
+
+//StripANSI removes escape sequences, including broken and truncated ones
+func StripANSI(c string) string {
+	text, colors := NewANSIDecoder().Decode(c)
+	return PlainText(text, colors)
+}
+
+//PlainText drops the bytes of a line that are marked as escape sequences
+func PlainText(line string, colors []ANSIData) string {
+	out := strings.Builder{}
+	out.Grow(len(line))
+	for i := 0; i < len(line); i++ {
+		if i < len(colors) && colors[i].Style&ANSI_STYLE_CONTROL != 0 {
+			continue
+		}
+		out.WriteByte(line[i])
+	}
+	return out.String()
+}
+
+//ANSIDecoder turns a stream of text into per-byte colors. It keeps the
+//current color between calls, and holds back an escape sequence that was
+//split across reads until the rest of it arrives.
+type ANSIDecoder struct {
+	cur     ANSIData
+	partial string
+}
+
+//Results of escapeEnd
+const ESC_INVALID = -1
+const ESC_INCOMPLETE = -2
+
+func NewANSIDecoder() *ANSIDecoder {
+	return &ANSIDecoder{cur: resolveColor(ANSI_DEFAULT)}
+}
+
+//Decode returns the text that is ready, with a color for each byte.
+//Escape sequences stay in the text, marked ANSI_CONTROL so they aren't drawn.
+func (d *ANSIDecoder) Decode(data string) (string, []ANSIData) {
+	t := d.partial + data
+	d.partial = ""
+	colors := make([]ANSIData, 0, len(t))
+
+	for z := 0; z < len(t); z++ {
+		if t[z] != '\033' {
+			colors = append(colors, d.cur)
+			continue
+		}
+
+		end := escapeEnd(t, z)
+		if end == ESC_INCOMPLETE {
+			//Wait for the rest
+			d.partial = t[z:]
+			t = t[:z]
+			break
+		}
+		if end == ESC_INVALID {
+			colors = append(colors, ANSI_CONTROL) //Lone escape, don't draw it
 			continue
 		}
-		if foundColor {
-			textColors[z] = ANSI_CONTROL //Not valid
-		} else {
-			textColors[z] = drawColor //Mark all characters with current color
+
+		for k := z; k <= end; k++ {
+			colors = append(colors, ANSI_CONTROL) //Mark the whole sequence as no-draw
+		}
+		//Only SGR changes the color, other sequences are dropped
+		if t[z+1] == '[' && t[end] == 'm' {
+			d.cur = ApplySGR(d.cur, t[z+2:end])
+		}
+		z = end
+	}
+	return t, colors
+}
+
+//Flush gives up on a held back escape sequence, it is returned undrawn
+func (d *ANSIDecoder) Flush() (string, []ANSIData) {
+	t := d.partial
+	d.partial = ""
+	colors := make([]ANSIData, len(t))
+	for i := range colors {
+		colors[i] = ANSI_CONTROL
+	}
+	return t, colors
+}
+
+//Color is the current color, what the next byte will be drawn with
+func (d *ANSIDecoder) Color() ANSIData {
+	return d.cur
+}
+
+//Recolor looks the current color up again, after a theme change
+func (d *ANSIDecoder) Recolor() {
+	d.cur = resolveColor(d.cur)
+}
+
+//escapeEnd returns the position of the last byte of the escape sequence
+//starting at pos, ESC_INCOMPLETE if t ends first, or ESC_INVALID
+func escapeEnd(t string, pos int) int {
+	if pos+1 >= len(t) {
+		return ESC_INCOMPLETE
+	}
+
+	switch c := t[pos+1]; {
+	case c == '[':
+		//CSI: "\033[" params intermediates final
+		for i := pos + 2; i < len(t); i++ {
+			if i-pos >= MAX_CSI_LENGTH {
+				return ESC_INVALID
+			}
+			c := t[i]
+			if c >= 0x40 && c <= 0x7E {
+				return i
+			}
+			//Only parameter and intermediate bytes are allowed before the final byte
+			if c < 0x20 || c > 0x3F {
+				return ESC_INVALID
+			}
+		}
+	case c == ']' || c == 'P' || c == '_' || c == '^':
+		//OSC, DCS, APC and PM are ended by BEL or "\033\\"
+		for i := pos + 2; i < len(t); i++ {
+			if i-pos >= MAX_ESC_STRING {
+				return ESC_INVALID
+			}
+			if t[i] == '\a' && c == ']' {
+				return i
+			}
+			if t[i] == '\033' {
+				if i+1 >= len(t) {
+					break
+				}
+				if t[i+1] == '\\' {
+					return i + 1
+				}
+				return ESC_INVALID
+			}
+		}
+	case c >= 0x20 && c <= 0x2F:
+		//nF, ex: "\033(B" charset selection, intermediates then one final byte
+		for i := pos + 1; i < len(t); i++ {
+			if t[i] >= 0x30 && t[i] <= 0x7E {
+				return i
+			}
+			if t[i] < 0x20 || t[i] > 0x2F {
+				return ESC_INVALID
+			}
 		}
+	case c >= 0x30 && c <= 0x7E:
+		//Two byte sequences, ex: "\0337" save cursor
+		return pos + 1
+	default:
+		return ESC_INVALID
 	}
-	return textColors
+	return ESC_INCOMPLETE
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStripANSI(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"empty", "", ""},
+		{"plain", "hello world", "hello world"},
+		{"escape at start", "\033[31mred", "red"},
+		{"escape at end", "red\033[0m", "red"},
+		{"keeps char before escape", "ab\033[1mcd", "abcd"},
+		{"several", "\033[1;31mA\033[0m \033[32mB\033[0m", "A B"},
+		{"adjacent", "\033[1m\033[4m\033[31mx", "x"},
+		{"empty params", "\033[mx", "x"},
+		{"256 color", "\033[38;5;208mo", "o"},
+		{"truecolor colon form", "\033[38:2::10:20:30mc", "c"},
+		{"cursor movement", "a\033[2Jb\033[10;5Hc", "abc"},
+		{"private mode", "\033[?25lhidden", "hidden"},
+		{"osc title bel", "\033]0;My Title\007text", "text"},
+		{"osc title st", "\033]0;My Title\033\\text", "text"},
+		{"charset select", "\033(Bline", "line"},
+		{"two byte", "\0337saved\0338", "saved"},
+		{"truncated csi", "abc\033[3", "abc"},
+		{"truncated csi params", "abc\033[38;5", "abc"},
+		{"lone escape at end", "abc\033", "abc"},
+		{"lone escape mid", "a\033\x01b", "a\x01b"},
+		{"bad byte in csi", "a\033[3\x01mb", "a[3\x01mb"},
+		{"overlong csi", "a\033[" + strings.Repeat("1", MAX_CSI_LENGTH) + "mb", "a[" + strings.Repeat("1", MAX_CSI_LENGTH) + "mb"},
+		{"utf-8", "\033[33mcafé 日本\033[0m", "café 日本"},
+		{"carriage return kept", "line\r", "line\r"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := StripANSI(tc.in)
+			if got != tc.want {
+				t.Errorf("StripANSI(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestANSIDecoderSplit(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+		index  int16 //Foreground palette index at the end
+	}{
+		{"split after escape", []string{"a\033", "[31mb"}, "ab", 1},
+		{"split in params", []string{"a\033[3", "2mb"}, "ab", 2},
+		{"split before final", []string{"a\033[1;34", "mb"}, "ab", 4},
+		{"split osc", []string{"a\033]0;ti", "tle\007b"}, "ab", ANSI_NO_INDEX},
+		{"one byte at a time", strings.Split("x\033[35my", ""), "xy", 5},
+		{"reset", []string{"\033[31m", "\033[0m", "z"}, "z", ANSI_NO_INDEX},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewANSIDecoder()
+			got := ""
+			for _, chunk := range tc.chunks {
+				text, colors := d.Decode(chunk)
+				if len(text) != len(colors) {
+					t.Fatalf("%d bytes but %d colors", len(text), len(colors))
+				}
+				got += PlainText(text, colors)
+			}
+			if got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+			if idx := d.Color().Index; idx != tc.index {
+				t.Errorf("color index %d, want %d", idx, tc.index)
+			}
+		})
+	}
+}
+
+func TestApplySGRStyles(t *testing.T) {
+	tests := []struct {
+		params string
+		style  uint8
+	}{
+		{"1;4;31", ANSI_STYLE_UNDERLINE},
+		{"3;4;7;9", ANSI_STYLE_ITALIC | ANSI_STYLE_UNDERLINE | ANSI_STYLE_INVERSE | ANSI_STYLE_STRIKE},
+		{"4;24", 0},
+		{"3;4;23", ANSI_STYLE_UNDERLINE},
+		{"5;7;0", 0},
+		{"5", ANSI_STYLE_BLINK},
+	}
+
+	for _, tc := range tests {
+		got := ApplySGR(ANSI_DEFAULT, tc.params)
+		if got.Style != tc.style {
+			t.Errorf("ApplySGR(%q) style = %b, want %b", tc.params, got.Style, tc.style)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+//Certificate verification modes
+const TLS_VERIFY_STRICT = 0 //System roots only
+const TLS_VERIFY_TOFU = 1   //System roots, else pin the fingerprint on first use
+
+const certFile = "known_certs.json"
+
+var tlsVerifyMode = TLS_VERIFY_TOFU
+
+//Server address -> SHA-256 fingerprint, pinned on first use or the last one
+//that verified against the system roots
+var knownCerts map[string]string
+var knownCertsLock sync.Mutex
+
+//Last certificate that failed to match its pin, waiting on the user
+var pendingCert struct {
+	addr        string
+	fingerprint string
+}
+
+type CertMismatchError struct {
+	Addr     string
+	Expected string
+	Got      string
+}
+
+func (e *CertMismatchError) Error() string {
+	return fmt.Sprintf("certificate for %s changed (pinned %s, got %s)", e.Addr, e.Expected, e.Got)
+}
+
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+//FormatFingerprint makes a fingerprint readable: AB:CD:EF...
+func FormatFingerprint(fp string) string {
+	fp = strings.ToUpper(fp)
+	parts := []string{}
+	for i := 0; i+2 <= len(fp); i += 2 {
+		parts = append(parts, fp[i:i+2])
+	}
+	return strings.Join(parts, ":")
+}
+
+func loadKnownCerts() {
+	if knownCerts != nil {
+		return
+	}
+	knownCerts = map[string]string{}
+
+	err := LoadJSON(certFile, &knownCerts)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println("known certs:", err)
+	}
+}
+
+func saveKnownCerts() {
+	err := SaveJSON(certFile, knownCerts)
+	if err != nil {
+		log.Println("known certs:", err)
+		AddLine(fmt.Sprintf("Unable to save certificate store: %s\r\n", err))
+	}
+}
+
+//TLSConfig builds a config that verifies against system roots,
+//then falls back to fingerprint pinning if TOFU is enabled.
+func TLSConfig(addr string) *tls.Config {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	return &tls.Config{
+		ServerName: host,
+		//We verify ourselves in VerifyConnection, so self-signed certs can be pinned
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return verifyCert(addr, host, cs)
+		},
+	}
+}
+
+func verifyCert(addr, host string, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+
+	opts := x509.VerifyOptions{
+		DNSName:       host,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, verr := leaf.Verify(opts)
+	fp := CertFingerprint(leaf)
+
+	knownCertsLock.Lock()
+	defer knownCertsLock.Unlock()
+	loadKnownCerts()
+	pinned, found := knownCerts[addr]
+
+	if verr == nil {
+		//Pin it too, so a later certificate that can't be verified
+		//counts as a change instead of a first contact
+		if pinned != fp {
+			knownCerts[addr] = fp
+			saveKnownCerts()
+		}
+		return nil
+	}
+	if tlsVerifyMode == TLS_VERIFY_STRICT {
+		return verr
+	}
+
+	if !found {
+		knownCerts[addr] = fp
+		saveKnownCerts()
+		AddLine(fmt.Sprintf("\033[1;33mCertificate for %s could not be verified (%s).\r\n"+
+			"Trusting it on first use, fingerprint:\r\n%s\033[0m\r\n", addr, verr, FormatFingerprint(fp)))
+		return nil
+	}
+	if pinned == fp {
+		return nil
+	}
+
+	pendingCert.addr = addr
+	pendingCert.fingerprint = fp
+	AddLine(fmt.Sprintf("\033[1;31m"+
+		"*********************************************************\r\n"+
+		"*  WARNING: THE CERTIFICATE FOR THIS SERVER HAS CHANGED  *\r\n"+
+		"*********************************************************\r\n"+
+		"Someone may be intercepting this connection, or the server\r\n"+
+		"may simply have a new certificate. Connection refused.\r\n"+
+		"Server: %s\r\nPinned: %s\r\nGot:    %s\r\n"+
+		"Use %scert accept to trust the new certificate, or %scert reject.\033[0m\r\n",
+		addr, FormatFingerprint(pinned), FormatFingerprint(fp), commandPrefix, commandPrefix))
+	return &CertMismatchError{Addr: addr, Expected: pinned, Got: fp}
+}
+
+//IsCertError reports if a dial failed because the certificate was not trusted
+func IsCertError(err error) bool {
+	var mismatch *CertMismatchError
+	var unknown x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+
+	return errors.As(err, &mismatch) || errors.As(err, &unknown) ||
+		errors.As(err, &hostname) || errors.As(err, &invalid)
+}
+
+//AcceptPendingCert pins the certificate that last failed to match
+func AcceptPendingCert() error {
+	knownCertsLock.Lock()
+	defer knownCertsLock.Unlock()
+
+	if pendingCert.addr == "" {
+		return errors.New("no changed certificate is waiting")
+	}
+	loadKnownCerts()
+	knownCerts[pendingCert.addr] = pendingCert.fingerprint
+	saveKnownCerts()
+
+	AddLine(fmt.Sprintf("Certificate for %s accepted: %s\r\n", pendingCert.addr, FormatFingerprint(pendingCert.fingerprint)))
+	pendingCert.addr = ""
+	pendingCert.fingerprint = ""
+	return nil
+}
+
+func RejectPendingCert() error {
+	knownCertsLock.Lock()
+	defer knownCertsLock.Unlock()
+
+	if pendingCert.addr == "" {
+		return errors.New("no changed certificate is waiting")
+	}
+	AddLine(fmt.Sprintf("Certificate for %s rejected, the old one stays pinned.\r\n", pendingCert.addr))
+	pendingCert.addr = ""
+	pendingCert.fingerprint = ""
+	return nil
+}
+
+//HasKnownCert reports if a certificate is pinned for the server
+func HasKnownCert(addr string) bool {
+	knownCertsLock.Lock()
+	defer knownCertsLock.Unlock()
+
+	loadKnownCerts()
+	_, found := knownCerts[addr]
+	return found
+}
+
+//ForgetCert removes a pin, the next connection will trust on first use again
+func ForgetCert(addr string) bool {
+	knownCertsLock.Lock()
+	defer knownCertsLock.Unlock()
+
+	loadKnownCerts()
+	if _, found := knownCerts[addr]; !found {
+		return false
+	}
+	delete(knownCerts, addr)
+	saveKnownCerts()
+	return true
+}
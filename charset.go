@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+//Telnet CHARSET, RFC 2066
+const TELOPT_CHARSET = 42
+
+const CHARSET_REQUEST = 1
+const CHARSET_ACCEPTED = 2
+const CHARSET_REJECTED = 3
+const CHARSET_TTABLE_IS = 4
+const CHARSET_TTABLE_REJECTED = 5
+
+//Charset converts between what the server sends and UTF-8
+type Charset struct {
+	Name    string //As used in CHARSET negotiation
+	Aliases []string
+	Decode  func(data []byte) string
+	Encode  func(text string) []byte
+}
+
+//High half of code page 437, 0x80-0xFF
+const cp437High = "ÇüéâäàåçêëèïîìÄÅ" +
+	"ÉæÆôöòûùÿÖÜ¢£¥₧ƒ" +
+	"áíóúñÑªº¿⌐¬½¼¡«»" +
+	"░▒▓│┤╡╢╖╕╣║╗╝╜╛┐" +
+	"└┴┬├─┼╞╟╚╔╩╦╠═╬╧" +
+	"╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀" +
+	"αßΓπΣσµτΦΘΩδ∞φε∩" +
+	"≡±≥≤⌠⌡÷≈°∙·√ⁿ²■ "
+
+var cp437Table []rune
+var cp437Reverse = map[rune]byte{}
+
+var charsetList = []*Charset{
+	{
+		Name:    "UTF-8",
+		Aliases: []string{"utf8"},
+		//Invalid bytes are left alone, they are drawn as the replacement character
+		Decode: func(data []byte) string { return string(data) },
+		Encode: func(text string) []byte { return []byte(text) },
+	},
+	{
+		Name:    "ISO-8859-1",
+		Aliases: []string{"latin1", "latin-1", "iso8859-1", "iso_8859-1"},
+		Decode: func(data []byte) string {
+			out := make([]rune, len(data))
+			for i, c := range data {
+				out[i] = rune(c)
+			}
+			return string(out)
+		},
+		Encode: func(text string) []byte {
+			return encodeSingleByte(text, func(r rune) (byte, bool) {
+				return byte(r), r < 0x100
+			})
+		},
+	},
+	{
+		Name:    "IBM437",
+		Aliases: []string{"cp437", "ibm-437", "437", "dos"},
+		Decode: func(data []byte) string {
+			out := make([]rune, len(data))
+			for i, c := range data {
+				if c < 0x80 {
+					out[i] = rune(c)
+				} else {
+					out[i] = cp437Table[c-0x80]
+				}
+			}
+			return string(out)
+		},
+		Encode: func(text string) []byte {
+			return encodeSingleByte(text, func(r rune) (byte, bool) {
+				if r < 0x80 {
+					return byte(r), true
+				}
+				c, found := cp437Reverse[r]
+				return c, found
+			})
+		},
+	},
+}
+
+var defaultCharset = charsetList[0]
+
+func init() {
+	cp437Table = []rune(cp437High)
+	for i, r := range cp437Table {
+		cp437Reverse[r] = byte(0x80 + i)
+	}
+
+	RegisterTelnetOption(&TelnetOption{
+		Code:     TELOPT_CHARSET,
+		Name:     "CHARSET",
+		Local:    true,
+		Remote:   true,
+		OnEnable: charsetEnable,
+		OnSub:    charsetSub,
+	})
+	RegisterSetting(&Setting{
+		Name: "charset",
+		Help: "Character set for new connections: utf-8, latin1 or cp437",
+		Get:  func() string { return defaultCharset.Name },
+		Set: func(val string) error {
+			cs := FindCharset(val)
+			if cs == nil {
+				return fmt.Errorf("unknown charset %s", val)
+			}
+			defaultCharset = cs
+			return nil
+		},
+	})
+	RegisterCommand(&Command{
+		Name: "charset",
+		Args: "[name]",
+		Help: "Show or change the character set of the current connection",
+		Run:  cmdCharset,
+	})
+}
+
+//encodeSingleByte converts text with a rune to byte mapping, '?' if there is none
+func encodeSingleByte(text string, conv func(r rune) (byte, bool)) []byte {
+	out := make([]byte, 0, len(text))
+	for _, r := range text {
+		c, ok := conv(r)
+		if !ok {
+			c = '?'
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+//FindCharset looks up a charset by name or alias, case-insensitive
+func FindCharset(name string) *Charset {
+	name = strings.TrimSpace(name)
+	for _, cs := range charsetList {
+		if strings.EqualFold(cs.Name, name) {
+			return cs
+		}
+		for _, alias := range cs.Aliases {
+			if strings.EqualFold(alias, name) {
+				return cs
+			}
+		}
+	}
+	return nil
+}
+
+func (t *Telnet) Charset() *Charset {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.charset == nil {
+		return defaultCharset
+	}
+	return t.charset
+}
+
+func (t *Telnet) SetCharset(cs *Charset) {
+	t.lock.Lock()
+	t.charset = cs
+	t.lock.Unlock()
+}
+
+//charsetEnable offers our charsets once the server agrees to CHARSET
+func charsetEnable(t *Telnet, local bool) {
+	if local {
+		//Server sent DO, it will send a REQUEST
+		return
+	}
+	names := []string{}
+	for _, cs := range charsetList {
+		names = append(names, cs.Name)
+	}
+	t.SendSub(TELOPT_CHARSET, []byte(fmt.Sprintf("%c;%s", CHARSET_REQUEST, strings.Join(names, ";"))))
+}
+
+func charsetSub(t *Telnet, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	switch data[0] {
+	case CHARSET_REQUEST:
+		list := data[1:]
+		//Translation tables are not supported, skip the version and use the list
+		if strings.HasPrefix(string(list), "[TTABLE]") && len(list) >= 9 {
+			list = list[9:]
+		}
+		if len(list) < 2 {
+			t.SendSub(TELOPT_CHARSET, []byte{CHARSET_REJECTED})
+			return
+		}
+
+		//First byte is the separator, the server lists its favorite first.
+		//UTF-8 wins wherever it is, otherwise take the first one we know.
+		utf8 := FindCharset("UTF-8")
+		var pick *Charset
+		pickName := ""
+		for _, name := range strings.Split(string(list[1:]), string(list[:1])) {
+			cs := FindCharset(name)
+			if cs != nil && (pick == nil || cs == utf8) {
+				pick, pickName = cs, name
+			}
+			if pick == utf8 {
+				break
+			}
+		}
+		if pick == nil {
+			t.SendSub(TELOPT_CHARSET, []byte{CHARSET_REJECTED})
+			return
+		}
+		t.SendSub(TELOPT_CHARSET, append([]byte{CHARSET_ACCEPTED}, pickName...))
+		setConnectionCharset(t, pick)
+
+	case CHARSET_ACCEPTED:
+		cs := FindCharset(string(data[1:]))
+		if cs == nil {
+			return
+		}
+		setConnectionCharset(t, cs)
+
+	case CHARSET_REJECTED:
+		AddLine(fmt.Sprintf("Server rejected our charsets, using %s.\r\n", t.Charset().Name))
+
+	case CHARSET_TTABLE_IS:
+		t.SendSub(TELOPT_CHARSET, []byte{CHARSET_TTABLE_REJECTED})
+	}
+}
+
+func setConnectionCharset(t *Telnet, cs *Charset) {
+	if t.Charset() == cs {
+		return
+	}
+	t.SetCharset(cs)
+	AddLine(fmt.Sprintf("Server switched the charset to %s.\r\n", cs.Name))
+}
+
+func cmdCharset(args []string) error {
+	_, tn := getCon()
+	if len(args) == 0 {
+		if tn == nil {
+			AddLine(fmt.Sprintf("Not connected, new connections use %s.\r\n", defaultCharset.Name))
+			return nil
+		}
+		AddLine(fmt.Sprintf("Charset: %s\r\n", tn.Charset().Name))
+		return nil
+	}
+
+	cs := FindCharset(args[0])
+	if cs == nil {
+		return fmt.Errorf("unknown charset %s, use utf-8, latin1 or cp437", args[0])
+	}
+	if tn == nil {
+		return fmt.Errorf("not connected, use %sset charset to change the default", commandPrefix)
+	}
+	tn.SetCharset(cs)
+	AddLine(fmt.Sprintf("Charset: %s\r\n", cs.Name))
+	return nil
+}
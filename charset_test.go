@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func charsetSubBytes(data string) string {
+	return iac(TELNET_SB, TELOPT_CHARSET) + data + iac(TELNET_SE)
+}
+
+func TestCharsetSub(t *testing.T) {
+	accepted := func(name string) string { return charsetSubBytes(raw(CHARSET_ACCEPTED) + name) }
+	rejected := charsetSubBytes(raw(CHARSET_REJECTED))
+
+	tests := []struct {
+		name    string
+		in      string
+		reply   string
+		charset string
+	}{
+		{"request one", raw(CHARSET_REQUEST) + ";UTF-8", accepted("UTF-8"), "UTF-8"},
+		{"request first known", raw(CHARSET_REQUEST) + ";KOI8-R;latin1;cp437", accepted("latin1"), "ISO-8859-1"},
+		{"request utf-8 last", raw(CHARSET_REQUEST) + ";ISO-8859-1;IBM437;utf-8", accepted("utf-8"), "UTF-8"},
+		{"request utf-8 first", raw(CHARSET_REQUEST) + ";UTF-8;ISO-8859-1", accepted("UTF-8"), "UTF-8"},
+		{"request none known", raw(CHARSET_REQUEST) + ";KOI8-R;EUC-JP", rejected, "UTF-8"},
+		{"request empty", raw(CHARSET_REQUEST), rejected, "UTF-8"},
+		{"request only separator", raw(CHARSET_REQUEST) + ";", rejected, "UTF-8"},
+		{"space separator", raw(CHARSET_REQUEST) + " IBM437 KOI8-R", accepted("IBM437"), "IBM437"},
+		{"high separator", raw(CHARSET_REQUEST) + "\x80ISO-8859-1\x80KOI8-R", accepted("ISO-8859-1"), "ISO-8859-1"},
+		{"separator 255", raw(CHARSET_REQUEST) + "\xff\xffKOI8-R\xff\xffcp437", accepted("cp437"), "IBM437"},
+		{"ttable", raw(CHARSET_REQUEST) + "[TTABLE]\x01;latin1", accepted("latin1"), "ISO-8859-1"},
+		{"ttable short", raw(CHARSET_REQUEST) + "[TTABLE]\x01;", rejected, "UTF-8"},
+		{"ttable no list", raw(CHARSET_REQUEST) + "[TTABLE]\x01", rejected, "UTF-8"},
+		{"accepted", raw(CHARSET_ACCEPTED) + "ISO-8859-1", "", "ISO-8859-1"},
+		{"accepted alias", raw(CHARSET_ACCEPTED) + "cp437", "", "IBM437"},
+		{"accepted unknown", raw(CHARSET_ACCEPTED) + "KOI8-R", "", "UTF-8"},
+		{"rejected", raw(CHARSET_REJECTED), "", "UTF-8"},
+		{"ttable is", raw(CHARSET_TTABLE_IS) + "\x01junk", charsetSubBytes(raw(CHARSET_TTABLE_REJECTED)), "UTF-8"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tn, out := newTestTelnet()
+			tn.local[TELOPT_CHARSET] = true
+			tn.remote[TELOPT_CHARSET] = true
+
+			//The separator 255 is doubled on the wire, like any IAC
+			data := string(TelnetEscape([]byte(tc.in)))
+			tn.Process([]byte(charsetSubBytes(data)))
+
+			if out.String() != tc.reply {
+				t.Errorf("sent %q, want %q", out.Bytes(), tc.reply)
+			}
+			if tn.Charset().Name != tc.charset {
+				t.Errorf("charset %s, want %s", tn.Charset().Name, tc.charset)
+			}
+		})
+	}
+}
+
+func TestCharsetEnable(t *testing.T) {
+	tn, out := newTestTelnet()
+	tn.Process([]byte(iac(TELNET_WILL, TELOPT_CHARSET)))
+
+	want := iac(TELNET_DO, TELOPT_CHARSET) + charsetSubBytes(raw(CHARSET_REQUEST)+";UTF-8;ISO-8859-1;IBM437")
+	if out.String() != want {
+		t.Errorf("sent %q, want %q", out.Bytes(), want)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//Command is a client-side command, typed as <prefix><name> <args>
+type Command struct {
+	Name  string
+	Args  string //Usage shown in /help, ex: "<server:port>"
+	Help  string
+	Run   func(args []string) error
+	Alias []string
+	Raw   bool //Run gets the rest of the line as one argument, quotes and all
+}
+
+var commandPrefix = defaultCommandPrefix
+var startServer = defaultServer
+var localEcho = true
+
+var commandList = map[string]*Command{}
+var commandAlias = map[string]string{}
+
+//ErrQuit is returned from Update to close the client
+var ErrQuit = errors.New("quit")
+var quitRequested = false
+
+func init() {
+	RegisterCommand(&Command{
+		Name: "connect",
+		Args: "[tls://|auto://|telnet://]<server:port>",
+		Help: "Connect to a server, with no argument reconnects to the last one",
+		Run:  cmdConnect,
+	})
+	RegisterCommand(&Command{
+		Name: "disconnect",
+		Help: "Close the connection",
+		Run: func(args []string) error {
+			if !Disconnect() {
+				return errors.New("not connected")
+			}
+			return nil
+		},
+	})
+	RegisterCommand(&Command{
+		Name: "reconnect",
+		Help: "Reconnect to the current server",
+		Run:  func(args []string) error { return cmdConnect(nil) },
+	})
+	RegisterCommand(&Command{
+		Name:  "quit",
+		Help:  "Close the client",
+		Alias: []string{"exit"},
+		Run: func(args []string) error {
+			Disconnect()
+			quitRequested = true
+			return nil
+		},
+	})
+	RegisterCommand(&Command{
+		Name: "clear",
+		Help: "Clear the scrollback",
+		Run: func(args []string) error {
+			ClearLines()
+			return nil
+		},
+	})
+	RegisterCommand(&Command{
+		Name:  "help",
+		Args:  "[command]",
+		Help:  "List commands, or show help for one",
+		Alias: []string{"?"},
+		Run:   cmdHelp,
+	})
+	RegisterCommand(&Command{
+		Name: "set",
+		Args: "[setting [value]]",
+		Help: "List settings, show one, or change it",
+		Run:  cmdSet,
+	})
+	RegisterCommand(&Command{
+		Name: "log",
+		Args: "[start [file]|stop]",
+		Help: "Log the session to a file, with no argument shows the log status",
+		Run:  cmdLog,
+	})
+	RegisterCommand(&Command{
+		Name: "cert",
+		Args: "<accept|reject|forget [server:port]>",
+		Help: "Accept or reject a changed server certificate, or forget a pinned one",
+		Run:  cmdCert,
+	})
+	RegisterCommand(&Command{
+		Name: "telnet",
+		Args: "[option on|off]",
+		Help: "Show telnet options, or allow/refuse one for the current server",
+		Run:  cmdTelnet,
+	})
+}
+
+func RegisterCommand(cmd *Command) {
+	commandList[cmd.Name] = cmd
+	for _, alias := range cmd.Alias {
+		commandAlias[alias] = cmd.Name
+	}
+}
+
+func FindCommand(name string) *Command {
+	name = strings.ToLower(name)
+	if real, found := commandAlias[name]; found {
+		name = real
+	}
+	return commandList[name]
+}
+
+func CommandNames() []string {
+	names := make([]string, 0, len(commandList))
+	for name := range commandList {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//IsCommand reports if an input line is meant for the client.
+//A doubled prefix is not, it is sent to the server with one prefix removed.
+func IsCommand(line string) bool {
+	return strings.HasPrefix(line, commandPrefix) && !strings.HasPrefix(line, commandPrefix+commandPrefix)
+}
+
+//ParseArgs splits a line on spaces, "double quotes" group words
+func ParseArgs(line string) []string {
+	args := []string{}
+	cur := strings.Builder{}
+	inQuote := false
+	hasArg := false
+
+	for _, r := range line {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			hasArg = true
+		case (r == ' ' || r == '\t') && !inQuote:
+			if hasArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				hasArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			hasArg = true
+		}
+	}
+	if hasArg {
+		args = append(args, cur.String())
+	}
+	return args
+}
+
+//RunCommand runs a line starting with the command prefix
+func RunCommand(line string) {
+	args := ParseArgs(strings.TrimPrefix(line, commandPrefix))
+	if len(args) == 0 {
+		return
+	}
+
+	cmd := FindCommand(args[0])
+	if cmd == nil {
+		AddLine(fmt.Sprintf("Unknown command: %s%s, try %shelp\r\n", commandPrefix, args[0], commandPrefix))
+		return
+	}
+
+	if cmd.Raw {
+		//Everything after the command name, untouched
+		rest := strings.TrimLeft(strings.TrimPrefix(line, commandPrefix), " \t")
+		rest = strings.TrimSpace(rest[strings.IndexAny(rest+" ", " \t"):])
+		args = args[:1]
+		if rest != "" {
+			args = append(args, rest)
+		}
+	}
+
+	err := cmd.Run(args[1:])
+	if err != nil {
+		AddLine(fmt.Sprintf("%s%s: %s\r\n", commandPrefix, cmd.Name, err))
+	}
+}
+
+//CompleteCommand finishes a partly typed command name in the input line
+func CompleteCommand(in *InputData) {
+	line := string(in.text)
+	if !IsCommand(line) || strings.ContainsAny(line, " \t") {
+		return
+	}
+	part := strings.ToLower(strings.TrimPrefix(line, commandPrefix))
+
+	matches := []string{}
+	for _, name := range CommandNames() {
+		if strings.HasPrefix(name, part) {
+			matches = append(matches, name)
+		}
+	}
+
+	if len(matches) == 0 {
+		return
+	} else if len(matches) == 1 {
+		in.SetText(commandPrefix + matches[0] + " ")
+		return
+	}
+
+	//Several matches, fill in what they share and list them
+	common := matches[0]
+	for _, name := range matches[1:] {
+		for !strings.HasPrefix(name, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	in.SetText(commandPrefix + common)
+	AddLine(commandPrefix + strings.Join(matches, "  "+commandPrefix) + "\r\n")
+}
+
+func cmdConnect(args []string) error {
+	addr := MainWin.serverAddr
+	if len(args) > 0 {
+		addr = args[0]
+	}
+	if addr == "" {
+		return errors.New("no server given")
+	}
+
+	Dial(addr)
+	return nil
+}
+
+func cmdHelp(args []string) error {
+	if len(args) > 0 {
+		cmd := FindCommand(strings.TrimPrefix(args[0], commandPrefix))
+		if cmd == nil {
+			return fmt.Errorf("no command named %s", args[0])
+		}
+		buf := fmt.Sprintf("%s%s %s\r\n  %s\r\n", commandPrefix, cmd.Name, cmd.Args, cmd.Help)
+		if len(cmd.Alias) > 0 {
+			buf += fmt.Sprintf("  Also: %s%s\r\n", commandPrefix, strings.Join(cmd.Alias, ", "+commandPrefix))
+		}
+		AddLine(buf)
+		return nil
+	}
+
+	buf := "Client commands:\r\n"
+	for _, name := range CommandNames() {
+		cmd := commandList[name]
+		usage := commandPrefix + cmd.Name
+		if cmd.Args != "" {
+			usage += " " + cmd.Args
+		}
+		buf += fmt.Sprintf("  %-36s %s\r\n", usage, cmd.Help)
+	}
+	buf += fmt.Sprintf("Start a line with %s%s to send it to the server as-is.\r\n", commandPrefix, commandPrefix)
+	AddLine(buf)
+	return nil
+}
+
+func cmdSet(args []string) error {
+	if len(args) == 0 {
+		buf := "Settings:\r\n"
+		for _, name := range SettingNames() {
+			s := settingsList[name]
+			buf += fmt.Sprintf("  %-14s %-16s %s\r\n", s.Name, s.Get(), s.Help)
+		}
+		AddLine(buf)
+		return nil
+	}
+
+	s := GetSetting(args[0])
+	if s == nil {
+		return fmt.Errorf("no setting named %s", args[0])
+	}
+	if len(args) == 1 {
+		AddLine(fmt.Sprintf("%s = %s\r\n  %s\r\n", s.Name, s.Get(), s.Help))
+		return nil
+	}
+
+	err := s.Set(strings.Join(args[1:], " "))
+	if err != nil {
+		return err
+	}
+	SaveSettings()
+	AddLine(fmt.Sprintf("%s = %s\r\n", s.Name, s.Get()))
+	return nil
+}
+
+func cmdLog(args []string) error {
+	if len(args) == 0 {
+		if name := LogFileName(); name != "" {
+			AddLine(fmt.Sprintf("Logging to %s\r\n", name))
+		} else {
+			AddLine("Not logging.\r\n")
+		}
+		return nil
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "start", "on":
+		name := ""
+		if len(args) > 1 {
+			name = args[1]
+		}
+		return StartLog(name)
+	case "stop", "off":
+		return StopLog()
+	}
+	return errors.New("use start [file] or stop")
+}
+
+func cmdCert(args []string) error {
+	if len(args) == 0 {
+		return errors.New("use accept, reject or forget")
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "accept":
+		return AcceptPendingCert()
+	case "reject":
+		return RejectPendingCert()
+	case "forget":
+		host, _ := ParseServerAddr(MainWin.serverAddr)
+		if len(args) > 1 {
+			host, _ = ParseServerAddr(args[1])
+		}
+		if !ForgetCert(host) {
+			return fmt.Errorf("no certificate pinned for %s", host)
+		}
+		AddLine(fmt.Sprintf("Forgot the certificate for %s.\r\n", host))
+		return nil
+	}
+	return errors.New("use accept, reject or forget")
+}
+
+func cmdTelnet(args []string) error {
+	host, _ := ParseServerAddr(MainWin.serverAddr)
+
+	if len(args) == 0 {
+		_, tn := getCon()
+		codes := []int{}
+		for code := range telnetOptions {
+			codes = append(codes, int(code))
+		}
+		sort.Ints(codes)
+
+		buf := fmt.Sprintf("Telnet options for %s:\r\n", host)
+		for _, c := range codes {
+			code := byte(c)
+			state := "off"
+			if tn != nil && (tn.IsLocal(code) || tn.IsRemote(code)) {
+				state = "active"
+			}
+			allowed := "allowed"
+			if over, found := ServerTelnetOption(host, code); found && !over {
+				allowed = "refused"
+			}
+			buf += fmt.Sprintf("  %-4d %-10s %-8s %s\r\n", code, telnetOptions[code].Name, allowed, state)
+		}
+		AddLine(buf)
+		return nil
+	}
+
+	if len(args) < 2 {
+		return errors.New("use <option> on|off")
+	}
+	opt := TelnetOptionByName(args[0])
+	if opt == nil {
+		return fmt.Errorf("unknown option %s", args[0])
+	}
+	on, err := ParseBool(args[1])
+	if err != nil {
+		return err
+	}
+	SetServerTelnetOption(host, opt.Code, on)
+
+	state := "refused"
+	if on {
+		state = "allowed"
+	}
+	AddLine(fmt.Sprintf("%s %s for %s, reconnect to apply.\r\n", opt.Name, state, host))
+	return nil
+}
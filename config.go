@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+//ConfigPath returns the path of a file in our config dir, creating the dir if needed
+func ConfigPath(name string) string {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		base = "."
+	}
+	dir := filepath.Join(base, configDirName)
+
+	err = os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0700)
+	if err != nil {
+		log.Println("config dir:", err)
+	}
+	return filepath.Join(dir, name)
+}
+
+func LoadJSON(name string, v interface{}) error {
+	data, err := ioutil.ReadFile(ConfigPath(name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+//SaveJSON writes to a temp file first, so a crash can't leave a half-written config
+func SaveJSON(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := ConfigPath(name)
+	err = ioutil.WriteFile(path+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -1,16 +1,28 @@
 package main
 
 const glyphCacheSize = 256
+const blinkTicks = 30 //Half a second at 60 TPS
 const defaultFontSize = 18.0
 const clearEveryFrame = true
 
 //Constants
 const MAX_INPUT_LENGTH = 100 * 1024 //100kb, some kind of reasonable limit for net/input buffer
 const NET_POLL_MS = 66              //1/15th of a second
+const CONNECT_TIMEOUT_SEC = 15
 
-const MAX_SCROLL_LINES = 10000 //Max scrollback
-const MAX_VIEW_LINES = 250     //Maximum lines on screen
+const MAX_INPUT_LINE = 4096 //Longest line the user can type
+const MAX_HISTORY = 1000    //Input history entries kept per server
 
+const defaultScrollLines = 10000 //Scrollback, see /set scrollback
+const MIN_SCROLL_LINES = 100
+const MAX_SCROLL_LINES = 1000000 //Max scrollback
+
+const MAX_VIEW_LINES = 250 //Maximum lines on screen
+const wheelScrollLines = 3 //Lines per mouse wheel notch
+const MAX_WRAP_INDENT = 20 //Hanging indent limit, in columns
+
+const configDirName = "gomud-client"
+const defaultCommandPrefix = "/"
 const defaultWindowTitle = "GoMud-Client"
 const defaultServer = "127.0.0.1:7778"
 const VersionString = "Pre-Alpha build, v0.0.031 07092021-1201a"
@@ -21,6 +33,9 @@ const defaultVerticalSpace = 4.0
 const defaultWindowWidth = 960
 const defaultWindowHeight = 540
 const defaultUserScale = 1.0
+const minUserScale = 0.5
+const maxUserScale = 4.0
+const userScaleStep = 0.1
 
 const defaultRepeatInterval = 3
 const defaultRepeatDelay = 30
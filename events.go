@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+//Event is a message from the server outside of the text stream, ex: GMCP
+type Event struct {
+	Source string //Protocol it came from, ex: "gmcp"
+	Name   string //ex: "Char.Vitals"
+	Data   interface{}
+}
+
+type eventSub struct {
+	id      int
+	source  string
+	prefix  string
+	handler func(ev Event)
+}
+
+var eventSubs []eventSub
+var eventSubID int
+var eventLock sync.Mutex
+
+//Subscribe calls handler for events from source whose name starts with
+//prefix, case-insensitive. An empty source or prefix matches everything.
+//Handlers run on the network goroutine, so keep them short.
+//Returns an id for Unsubscribe.
+func Subscribe(source, prefix string, handler func(ev Event)) int {
+	eventLock.Lock()
+	defer eventLock.Unlock()
+
+	eventSubID++
+	eventSubs = append(eventSubs, eventSub{
+		id:      eventSubID,
+		source:  strings.ToLower(source),
+		prefix:  strings.ToLower(prefix),
+		handler: handler,
+	})
+	return eventSubID
+}
+
+func Unsubscribe(id int) {
+	eventLock.Lock()
+	defer eventLock.Unlock()
+
+	for i, sub := range eventSubs {
+		if sub.id == id {
+			eventSubs = append(eventSubs[:i], eventSubs[i+1:]...)
+			return
+		}
+	}
+}
+
+//Publish sends an event to every matching subscriber
+func Publish(ev Event) {
+	source := strings.ToLower(ev.Source)
+	name := strings.ToLower(ev.Name)
+
+	//Copy, so handlers can subscribe and unsubscribe
+	eventLock.Lock()
+	subs := append([]eventSub(nil), eventSubs...)
+	eventLock.Unlock()
+
+	for _, sub := range subs {
+		if sub.source != "" && sub.source != source {
+			continue
+		}
+		if strings.HasPrefix(name, sub.prefix) {
+			sub.handler(ev)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEventMatching(t *testing.T) {
+	subs := []struct {
+		source string
+		prefix string
+	}{
+		{"", ""},
+		{"gmcp", ""},
+		{"GMCP", "char."},
+		{"gmcp", "Char.Vitals"},
+		{"msdp", ""},
+		{"msdp", "HEALTH"},
+	}
+	tests := []struct {
+		source string
+		name   string
+		want   []int //Indexes into subs
+	}{
+		{"gmcp", "Char.Vitals", []int{0, 1, 2, 3}},
+		{"gmcp", "CHAR.VITALS.EXTRA", []int{0, 1, 2, 3}},
+		{"gmcp", "Char.Name", []int{0, 1, 2}},
+		{"gmcp", "Room.Info", []int{0, 1}},
+		{"gmcp", "Char", []int{0, 1}},
+		{"MSDP", "HEALTH_MAX", []int{0, 4, 5}},
+		{"msdp", "MANA", []int{0, 4}},
+		{"other", "Char.Vitals", []int{0}},
+	}
+
+	var got []int
+	for i, sub := range subs {
+		i := i
+		id := Subscribe(sub.source, sub.prefix, func(ev Event) { got = append(got, i) })
+		defer Unsubscribe(id)
+	}
+
+	for _, tc := range tests {
+		got = nil
+		Publish(Event{Source: tc.source, Name: tc.name})
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s %s went to %v, want %v", tc.source, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestEventUnsubscribe(t *testing.T) {
+	calls := 0
+	var id int
+	id = Subscribe("test", "", func(ev Event) {
+		calls++
+		//Handlers may unsubscribe while an event is being sent
+		Unsubscribe(id)
+	})
+	other := Subscribe("test", "", func(ev Event) { calls += 10 })
+
+	Publish(Event{Source: "test", Name: "a"})
+	Publish(Event{Source: "test", Name: "b"})
+	Unsubscribe(other)
+	Publish(Event{Source: "test", Name: "c"})
+
+	if calls != 21 {
+		t.Errorf("calls %d, want 21", calls)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+)
+
+func init() {
+	RegisterSetting(&Setting{
+		Name: "fontscale",
+		Help: "Font zoom, also changed with Ctrl+= and Ctrl+-",
+		Get:  func() string { return strconv.FormatFloat(MainWin.userScale, 'f', 2, 64) },
+		Set: func(val string) error {
+			scale, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return fmt.Errorf("%q is not a number", val)
+			}
+			if scale < minUserScale || scale > maxUserScale {
+				return fmt.Errorf("must be between %.2f and %.2f", minUserScale, maxUserScale)
+			}
+			MainWin.userScale = scale
+			updateFont()
+			return nil
+		},
+	})
+}
+
+//updateFont rebuilds the font face for the current scale and re-renders everything
+func updateFont() {
+	ebitenLock.Lock()
+	MainWin.font.size = defaultFontSize * MainWin.userScale
+	MainWin.font.face = truetype.NewFace(tt, &truetype.Options{
+		Size:              float64(MainWin.font.size),
+		Hinting:           font.HintingFull,
+		GlyphCacheEntries: glyphCacheSize,
+	})
+
+	//Font setup
+	MainWin.font.vertSpace = MainWin.font.size / defaultVerticalSpace
+	MainWin.font.charWidth = MainWin.font.size / defaultHorizontalSpace
+	MainWin.font.charHeight = MainWin.font.size + MainWin.font.vertSpace
+	ebitenLock.Unlock()
+
+	//Cached line images are the wrong size now, and fewer or more characters fit
+	MainWin.lines.Rewrap()
+	MainWin.input.dirty = true
+	MainWin.viewChanged = true
+	renderText()
+	SendWindowSize()
+}
+
+//zoomFont steps the font scale, 0 resets it
+func zoomFont(step float64) {
+	scale := defaultUserScale
+	if step != 0 {
+		scale = MainWin.userScale + step
+	}
+	//Avoid 1.2000000001
+	scale = math.Round(scale*100) / 100
+
+	if scale < minUserScale {
+		scale = minUserScale
+	} else if scale > maxUserScale {
+		scale = maxUserScale
+	}
+	if scale == MainWin.userScale {
+		return
+	}
+
+	MainWin.userScale = scale
+	updateFont()
+	SaveSettings()
+}
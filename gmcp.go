@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+//GMCP, Generic MUD Communication Protocol
+const TELOPT_GMCP = 201
+
+//Packages we tell the server we understand, sent with Core.Supports.Set
+var gmcpSupports = []string{"Core 1", "Char 1", "Room 1", "Comm 1"}
+
+var gmcpDebug = false
+
+func init() {
+	RegisterTelnetOption(&TelnetOption{
+		Code:      TELOPT_GMCP,
+		Name:      "GMCP",
+		Remote:    true,
+		OnEnable:  gmcpEnable,
+		OnDisable: func(t *Telnet, local bool) { t.gmcpClear() },
+		OnSub:     gmcpSub,
+	})
+	RegisterSetting(&Setting{
+		Name: "gmcpdebug",
+		Help: "Show GMCP messages from the server in the scrollback",
+		Get:  func() string { return FormatBool(gmcpDebug) },
+		Set:  func(val string) error { return SetBool(&gmcpDebug, val) },
+	})
+	RegisterCommand(&Command{
+		Name: "gmcp",
+		Args: "[Package.Message [json]]",
+		Help: "List GMCP data from the server, show one message, or send one",
+		Run:  cmdGMCP,
+		Raw:  true,
+	})
+}
+
+//gmcpEnable introduces us once the server agrees to GMCP
+func gmcpEnable(t *Telnet, local bool) {
+	t.gmcpClear()
+	SendGMCP(t, "Core.Hello", map[string]string{
+		"client":  defaultWindowTitle,
+		"version": VersionString,
+	})
+	SendGMCP(t, "Core.Supports.Set", gmcpSupports)
+}
+
+//gmcpSub handles "Package.Message {json}", the data is optional
+func gmcpSub(t *Telnet, data []byte) {
+	msg := strings.TrimSpace(string(data))
+	name, body := msg, ""
+	if i := strings.IndexAny(msg, " \t\r\n"); i >= 0 {
+		name, body = msg[:i], strings.TrimSpace(msg[i+1:])
+	}
+	if name == "" {
+		return
+	}
+
+	var raw json.RawMessage
+	if body != "" {
+		if !json.Valid([]byte(body)) {
+			log.Printf("gmcp: bad json in %s: %s\n", name, body)
+			return
+		}
+		raw = json.RawMessage(body)
+	}
+
+	t.lock.Lock()
+	if t.gmcpData == nil {
+		t.gmcpData = map[string]json.RawMessage{}
+	}
+	t.gmcpData[strings.ToLower(name)] = raw
+	t.lock.Unlock()
+
+	if gmcpDebug {
+		AddLine(fmt.Sprintf("GMCP: %s %s\r\n", name, body))
+	}
+	Publish(Event{Source: "gmcp", Name: name, Data: raw})
+}
+
+//SendGMCP sends a message, data is encoded as JSON unless it is nil
+func SendGMCP(t *Telnet, name string, data interface{}) error {
+	if t == nil || !t.IsRemote(TELOPT_GMCP) {
+		return errors.New("GMCP is not enabled")
+	}
+
+	msg := []byte(name)
+	if data != nil {
+		body, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		msg = append(append(msg, ' '), body...)
+	}
+	return t.SendSub(TELOPT_GMCP, msg)
+}
+
+//GMCPData returns the last message of a kind on this connection, ex: "Char.Vitals"
+func (t *Telnet) GMCPData(name string) (json.RawMessage, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	data, found := t.gmcpData[strings.ToLower(name)]
+	return data, found
+}
+
+//GMCPNames lists the kinds of message received on this connection
+func (t *Telnet) GMCPNames() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	names := make([]string, 0, len(t.gmcpData))
+	for name := range t.gmcpData {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (t *Telnet) gmcpClear() {
+	t.lock.Lock()
+	t.gmcpData = nil
+	t.lock.Unlock()
+}
+
+func cmdGMCP(args []string) error {
+	_, tn := getCon()
+	if len(args) == 0 {
+		names := []string{}
+		if tn != nil {
+			names = tn.GMCPNames()
+		}
+		if len(names) == 0 {
+			AddLine("No GMCP data received.\r\n")
+			return nil
+		}
+		AddLine("GMCP data: " + strings.Join(names, ", ") + "\r\n")
+		return nil
+	}
+
+	name, body := args[0], ""
+	if i := strings.IndexAny(name, " \t"); i >= 0 {
+		name, body = name[:i], strings.TrimSpace(name[i+1:])
+	}
+
+	if body == "" {
+		if tn == nil {
+			return errors.New("not connected")
+		}
+		data, found := tn.GMCPData(name)
+		if !found {
+			return fmt.Errorf("no %s received", name)
+		}
+		AddLine(fmt.Sprintf("%s %s\r\n", name, data))
+		return nil
+	}
+
+	if !json.Valid([]byte(body)) {
+		return errors.New("data must be valid JSON")
+	}
+	return SendGMCP(tn, name, json.RawMessage(body))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func gmcpSubBytes(msg string) string {
+	return iac(TELNET_SB, TELOPT_GMCP) + msg + iac(TELNET_SE)
+}
+
+//recordEvents collects events from source until the test ends
+func recordEvents(t *testing.T, source string) *[]Event {
+	events := &[]Event{}
+	id := Subscribe(source, "", func(ev Event) { *events = append(*events, ev) })
+	t.Cleanup(func() { Unsubscribe(id) })
+	return events
+}
+
+func TestGMCPSub(t *testing.T) {
+	tests := []struct {
+		name  string
+		msg   string
+		key   string //Looked up with GMCPData, "" if nothing is stored
+		data  string
+		event string
+	}{
+		{"with body", `Char.Vitals {"hp": 10}`, "Char.Vitals", `{"hp": 10}`, "Char.Vitals"},
+		{"no body", "Core.Ping", "Core.Ping", "", "Core.Ping"},
+		{"tab", "Room.Info\t{\"num\": 1}", "Room.Info", `{"num": 1}`, "Room.Info"},
+		{"newline", "Room.Info\n[1, 2]", "Room.Info", "[1, 2]", "Room.Info"},
+		{"extra space", "  Char.Name   \"Bob\"  ", "Char.Name", `"Bob"`, "Char.Name"},
+		{"any case", `CHAR.Vitals {"hp": 1}`, "char.vitals", `{"hp": 1}`, "CHAR.Vitals"},
+		{"string body", `Comm.Channel.Text "hi there"`, "comm.channel.text", `"hi there"`, "Comm.Channel.Text"},
+		{"bad json", `Char.Vitals {"hp": }`, "", "", ""},
+		{"text body", "Char.Name Bob", "", "", ""},
+		{"empty", "", "", "", ""},
+		{"only space", "   ", "", "", ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			events := recordEvents(t, "gmcp")
+			tn, _ := newTestTelnet()
+			tn.remote[TELOPT_GMCP] = true
+
+			tn.Process([]byte(gmcpSubBytes(tc.msg)))
+
+			if tc.key == "" {
+				if names := tn.GMCPNames(); len(names) != 0 {
+					t.Errorf("stored %v", names)
+				}
+				if len(*events) != 0 {
+					t.Errorf("published %v", *events)
+				}
+				return
+			}
+
+			data, found := tn.GMCPData(tc.key)
+			if !found || string(data) != tc.data {
+				t.Errorf("GMCPData(%q) = %q, %v, want %q", tc.key, data, found, tc.data)
+			}
+			if len(*events) != 1 {
+				t.Fatalf("published %d events, want 1", len(*events))
+			}
+			ev := (*events)[0]
+			if ev.Source != "gmcp" || ev.Name != tc.event {
+				t.Errorf("event %s %s, want gmcp %s", ev.Source, ev.Name, tc.event)
+			}
+			if raw, _ := ev.Data.(json.RawMessage); string(raw) != tc.data {
+				t.Errorf("event data %q, want %q", raw, tc.data)
+			}
+		})
+	}
+}
+
+func TestGMCPKeepsLast(t *testing.T) {
+	tn, _ := newTestTelnet()
+	tn.remote[TELOPT_GMCP] = true
+
+	tn.Process([]byte(gmcpSubBytes(`Char.Vitals {"hp": 1}`) + gmcpSubBytes(`Room.Info {}`) + gmcpSubBytes(`char.vitals {"hp": 2}`)))
+	if data, _ := tn.GMCPData("Char.Vitals"); string(data) != `{"hp": 2}` {
+		t.Errorf("Char.Vitals = %q, want the newest", data)
+	}
+	if names := tn.GMCPNames(); !reflect.DeepEqual(names, []string{"char.vitals", "room.info"}) {
+		t.Errorf("names %q", names)
+	}
+
+	//Each connection starts empty, and turning GMCP off clears it
+	if names := NewTelnet("other.example", nil).GMCPNames(); len(names) != 0 {
+		t.Errorf("new connection has %q", names)
+	}
+	tn.Process([]byte(iac(TELNET_WONT, TELOPT_GMCP)))
+	if names := tn.GMCPNames(); len(names) != 0 {
+		t.Errorf("%q left after WONT GMCP", names)
+	}
+}
+
+func TestGMCPNotEnabled(t *testing.T) {
+	events := recordEvents(t, "")
+	tn, _ := newTestTelnet()
+
+	tn.Process([]byte(gmcpSubBytes(`Char.Vitals {"hp": 1}`)))
+	if len(tn.GMCPNames()) != 0 || len(*events) != 0 {
+		t.Error("GMCP message used before the server offered GMCP")
+	}
+}
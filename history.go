@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/hajimehoshi/ebiten"
+	"github.com/hajimehoshi/ebiten/inpututil"
+)
+
+const searchPrompt = "(reverse-i-search)`"
+
+type HistoryData struct {
+	profile string
+	entries []string
+
+	pos   int    //Entry being shown, len(entries) when not browsing
+	saved string //What was typed before browsing started
+
+	searching bool
+	query     string
+	match     int //Entry matching query, -1 if none
+}
+
+//ProfileName turns a server address into something safe for a file name
+func ProfileName(addr string) string {
+	host, _ := ParseServerAddr(addr)
+	return strings.Map(func(r rune) rune {
+		if r < 128 && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-') {
+			return r
+		}
+		return '_'
+	}, host)
+}
+
+func historyPath(profile string) string {
+	return ConfigPath(filepath.Join("history", profile+".txt"))
+}
+
+//Load switches to the history of another server profile
+func (h *HistoryData) Load(profile string) {
+	if profile == h.profile && h.entries != nil {
+		return
+	}
+	h.profile = profile
+	h.entries = []string{}
+	h.reset()
+
+	file, err := os.Open(historyPath(profile))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("history:", err)
+		}
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, MAX_INPUT_LINE*4), MAX_INPUT_LINE*4)
+	for scanner.Scan() {
+		h.entries = append(h.entries, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		log.Println("history:", err)
+	}
+
+	if len(h.entries) > MAX_HISTORY {
+		h.entries = h.entries[len(h.entries)-MAX_HISTORY:]
+		h.save()
+	}
+	h.pos = len(h.entries)
+}
+
+//save rewrites the whole file, only needed when trimming
+func (h *HistoryData) save() {
+	if h.profile == "" {
+		return
+	}
+	data := strings.Join(h.entries, "\n") + "\n"
+	err := ioutil.WriteFile(historyPath(h.profile), []byte(data), 0600)
+	if err != nil {
+		log.Println("history:", err)
+	}
+}
+
+//Add records a sent line, skipping blanks and repeats of the last entry
+func (h *HistoryData) Add(line string) {
+	defer h.reset()
+
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if len(h.entries) > 0 && h.entries[len(h.entries)-1] == line {
+		return
+	}
+	h.entries = append(h.entries, line)
+
+	if len(h.entries) > MAX_HISTORY*2 {
+		h.entries = h.entries[len(h.entries)-MAX_HISTORY:]
+		h.save()
+		return
+	}
+
+	if h.profile == "" {
+		return
+	}
+	file, err := os.OpenFile(historyPath(h.profile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Println("history:", err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(line + "\n"); err != nil {
+		log.Println("history:", err)
+	}
+}
+
+func (h *HistoryData) reset() {
+	h.pos = len(h.entries)
+	h.saved = ""
+	h.searching = false
+	h.query = ""
+	h.match = -1
+}
+
+//Prev shows the previous (older) entry in the input line
+func (h *HistoryData) Prev(in *InputData) {
+	if h.pos <= 0 {
+		return
+	}
+	if h.pos == len(h.entries) {
+		h.saved = string(in.text)
+	}
+	h.pos--
+	in.SetText(h.entries[h.pos])
+}
+
+//Next shows the next (newer) entry, or what was typed before browsing
+func (h *HistoryData) Next(in *InputData) {
+	if h.pos >= len(h.entries) {
+		return
+	}
+	h.pos++
+	if h.pos == len(h.entries) {
+		in.SetText(h.saved)
+	} else {
+		in.SetText(h.entries[h.pos])
+	}
+}
+
+//StartSearch begins a Ctrl+R search, or looks for an older match if already searching
+func (h *HistoryData) StartSearch(in *InputData) {
+	if !h.searching {
+		h.searching = true
+		h.saved = string(in.text)
+		h.query = ""
+		h.match = -1
+		in.dirty = true
+		return
+	}
+
+	from := h.match
+	if from < 0 {
+		from = len(h.entries)
+	}
+	h.find(from - 1)
+	in.dirty = true
+}
+
+//find looks backwards from an index for an entry containing the query
+func (h *HistoryData) find(from int) {
+	if h.query == "" {
+		return
+	}
+	if from >= len(h.entries) {
+		from = len(h.entries) - 1
+	}
+	for i := from; i >= 0; i-- {
+		if strings.Contains(h.entries[i], h.query) {
+			h.match = i
+			return
+		}
+	}
+	//No older match, keep the one we have (like bash)
+}
+
+//SearchText returns what the input line should show while searching,
+//and where the cursor goes
+func (h *HistoryData) SearchText() ([]rune, int) {
+	prefix := searchPrompt + h.query + "': "
+	found := ""
+	if h.match >= 0 && h.match < len(h.entries) {
+		found = h.entries[h.match]
+	}
+
+	cursor := len([]rune(prefix))
+	if pos := strings.Index(found, h.query); pos >= 0 && h.query != "" {
+		cursor += len([]rune(found[:pos]))
+	}
+	return []rune(prefix + found), cursor
+}
+
+//endSearch leaves search mode, putting the match (or the old text) in the input line
+func (h *HistoryData) endSearch(in *InputData, accept bool) {
+	text := h.saved
+	if accept && h.match >= 0 && h.match < len(h.entries) {
+		text = h.entries[h.match]
+	}
+	h.reset()
+	in.SetText(text)
+}
+
+//handleSearchInput handles keys while Ctrl+R search is active
+func handleSearchInput() {
+	h := &MainWin.history
+	in := &MainWin.input
+
+	if ctrlPressed() && inpututil.IsKeyJustPressed(ebiten.KeyR) {
+		h.StartSearch(in)
+		return
+	}
+
+	changed := false
+	for _, r := range ebiten.InputChars() {
+		if unicode.IsPrint(r) {
+			h.query += string(r)
+			changed = true
+		}
+	}
+
+	if RepeatingKeyPressed(ebiten.KeyBackspace) {
+		if q := []rune(h.query); len(q) > 0 {
+			h.query = string(q[:len(q)-1])
+			h.match = -1
+			changed = true
+		}
+	} else if inpututil.IsKeyJustPressed(ebiten.KeyEscape) ||
+		(ctrlPressed() && inpututil.IsKeyJustPressed(ebiten.KeyG)) {
+		h.endSearch(in, false)
+		return
+	} else if inpututil.IsKeyJustPressed(ebiten.KeyEnter) || inpututil.IsKeyJustPressed(ebiten.KeyKPEnter) {
+		h.endSearch(in, true)
+		submitInput()
+		return
+	} else if inpututil.IsKeyJustPressed(ebiten.KeyLeft) || inpututil.IsKeyJustPressed(ebiten.KeyRight) ||
+		inpututil.IsKeyJustPressed(ebiten.KeyUp) || inpututil.IsKeyJustPressed(ebiten.KeyDown) ||
+		inpututil.IsKeyJustPressed(ebiten.KeyHome) || inpututil.IsKeyJustPressed(ebiten.KeyEnd) {
+		//Accept the match for editing
+		h.endSearch(in, true)
+		return
+	}
+
+	if changed {
+		from := h.match
+		if from < 0 {
+			from = len(h.entries) - 1
+		}
+		h.find(from)
+		in.dirty = true
+	}
+}
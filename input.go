@@ -1,10 +1,25 @@
 package main
 
 import (
+	"image/color"
+	"log"
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/atotto/clipboard"
 	"github.com/hajimehoshi/ebiten"
+	"github.com/hajimehoshi/ebiten/ebitenutil"
 	"github.com/hajimehoshi/ebiten/inpututil"
+	"github.com/hajimehoshi/ebiten/text"
 )
 
+var inputBGColor = color.RGBA{0x20, 0x20, 0x20, 0xFF}
+var inputFGColor = color.RGBA{0xFF, 0xFF, 0xFF, 0xFF}
+var inputCursorColor = color.RGBA{0xC0, 0xC0, 0xC0, 0xFF}
+
+var wheelRemainder float64
+
 // RepeatingKeyPressed return true when key is pressed considering the repeat state.
 func RepeatingKeyPressed(key ebiten.Key) bool {
 	d := inpututil.KeyPressDuration(key)
@@ -16,3 +31,316 @@ func RepeatingKeyPressed(key ebiten.Key) bool {
 	}
 	return false
 }
+
+func ctrlPressed() bool {
+	return ebiten.IsKeyPressed(ebiten.KeyControl)
+}
+
+//handleInput reads the keyboard, edits the input line, sends on enter
+func handleInput() {
+	in := &MainWin.input
+	ctrl := ctrlPressed()
+
+	//Mouse wheel scrolls the scrollback, touchpads send fractions so keep the remainder
+	if _, dy := ebiten.Wheel(); dy != 0 {
+		wheelRemainder += dy * wheelScrollLines
+		lines := int(wheelRemainder)
+		wheelRemainder -= float64(lines)
+		scrollView(lines)
+	}
+
+	if MainWin.history.searching {
+		handleSearchInput()
+		return
+	}
+
+	//Typed characters
+	for _, r := range ebiten.InputChars() {
+		if unicode.IsPrint(r) {
+			in.Insert(string(r))
+		}
+	}
+
+	if RepeatingKeyPressed(ebiten.KeyEnter) || RepeatingKeyPressed(ebiten.KeyKPEnter) {
+		submitInput()
+
+	} else if ctrl && (RepeatingKeyPressed(ebiten.KeyEqual) || RepeatingKeyPressed(ebiten.KeyKPAdd)) {
+		zoomFont(userScaleStep)
+	} else if ctrl && (RepeatingKeyPressed(ebiten.KeyMinus) || RepeatingKeyPressed(ebiten.KeyKPSubtract)) {
+		zoomFont(-userScaleStep)
+	} else if ctrl && inpututil.IsKeyJustPressed(ebiten.Key0) {
+		zoomFont(0)
+
+	} else if inpututil.IsKeyJustPressed(ebiten.KeyTab) {
+		CompleteCommand(in)
+	} else if ctrl && inpututil.IsKeyJustPressed(ebiten.KeyR) {
+		MainWin.history.StartSearch(in)
+	} else if RepeatingKeyPressed(ebiten.KeyUp) {
+		MainWin.history.Prev(in)
+	} else if RepeatingKeyPressed(ebiten.KeyDown) {
+		MainWin.history.Next(in)
+
+	} else if RepeatingKeyPressed(ebiten.KeyLeft) {
+		if ctrl {
+			in.WordLeft()
+		} else {
+			in.Move(-1)
+		}
+	} else if RepeatingKeyPressed(ebiten.KeyRight) {
+		if ctrl {
+			in.WordRight()
+		} else {
+			in.Move(1)
+		}
+	} else if RepeatingKeyPressed(ebiten.KeyPageUp) {
+		scrollView(visibleRows() - 1)
+	} else if RepeatingKeyPressed(ebiten.KeyPageDown) {
+		scrollView(-(visibleRows() - 1))
+	} else if ctrl && inpututil.IsKeyJustPressed(ebiten.KeyHome) {
+		setScroll(maxScroll())
+	} else if ctrl && inpututil.IsKeyJustPressed(ebiten.KeyEnd) {
+		setScroll(0)
+	} else if RepeatingKeyPressed(ebiten.KeyHome) {
+		in.SetCursor(0)
+	} else if RepeatingKeyPressed(ebiten.KeyEnd) {
+		in.SetCursor(len(in.text))
+
+	} else if RepeatingKeyPressed(ebiten.KeyBackspace) {
+		if ctrl {
+			start := in.cursor
+			in.WordLeft()
+			in.Delete(in.cursor, start)
+		} else {
+			in.Delete(in.cursor-1, in.cursor)
+		}
+	} else if RepeatingKeyPressed(ebiten.KeyDelete) {
+		if ctrl {
+			start := in.cursor
+			in.WordRight()
+			in.Delete(start, in.cursor)
+		} else {
+			in.Delete(in.cursor, in.cursor+1)
+		}
+
+	} else if (ctrl && inpututil.IsKeyJustPressed(ebiten.KeyV)) ||
+		(ebiten.IsKeyPressed(ebiten.KeyShift) && inpututil.IsKeyJustPressed(ebiten.KeyInsert)) {
+		pasteClipboard()
+	}
+}
+
+//pasteClipboard inserts the clipboard, every complete line is sent as typed
+func pasteClipboard() {
+	data, err := clipboard.ReadAll()
+	if err != nil {
+		log.Println("clipboard:", err)
+		return
+	}
+
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	lines := strings.Split(data, "\n")
+	for i, line := range lines {
+		MainWin.input.Insert(strings.Map(dropControl, line))
+		if i < len(lines)-1 {
+			submitInput()
+		}
+	}
+}
+
+//submitInput runs or sends the input line and records it in the history
+func submitInput() {
+	line := string(MainWin.input.text)
+	MainWin.input.Clear()
+
+	//Never save what was typed while the server hid our echo, it is likely a password
+	if _, tn := getCon(); tn == nil || !tn.IsRemote(TELOPT_ECHO) {
+		MainWin.history.Add(line)
+	} else {
+		MainWin.history.reset()
+	}
+
+	if IsCommand(line) {
+		RunCommand(line)
+		return
+	}
+	//Doubled prefix, send the line with one prefix removed
+	if strings.HasPrefix(line, commandPrefix+commandPrefix) {
+		line = strings.TrimPrefix(line, commandPrefix)
+	}
+	SendLine(line)
+}
+
+func dropControl(r rune) rune {
+	if r == '\t' {
+		return ' '
+	}
+	if !unicode.IsPrint(r) {
+		return -1
+	}
+	return r
+}
+
+func (in *InputData) Insert(s string) {
+	if s == "" {
+		return
+	}
+	add := []rune(s)
+	if len(in.text)+len(add) > MAX_INPUT_LINE {
+		return
+	}
+
+	newText := make([]rune, 0, len(in.text)+len(add))
+	newText = append(newText, in.text[:in.cursor]...)
+	newText = append(newText, add...)
+	newText = append(newText, in.text[in.cursor:]...)
+	in.text = newText
+	in.cursor += len(add)
+	in.dirty = true
+}
+
+//Delete removes runes between start and end
+func (in *InputData) Delete(start, end int) {
+	if start < 0 {
+		start = 0
+	}
+	if end > len(in.text) {
+		end = len(in.text)
+	}
+	if start >= end {
+		return
+	}
+
+	in.text = append(in.text[:start], in.text[end:]...)
+	in.cursor = start
+	in.dirty = true
+}
+
+func (in *InputData) Clear() {
+	in.text = nil
+	in.cursor = 0
+	in.scroll = 0
+	in.dirty = true
+}
+
+func (in *InputData) SetText(s string) {
+	in.text = []rune(s)
+	in.cursor = len(in.text)
+	in.dirty = true
+}
+
+func (in *InputData) SetCursor(pos int) {
+	if pos < 0 {
+		pos = 0
+	}
+	if pos > len(in.text) {
+		pos = len(in.text)
+	}
+	in.cursor = pos
+	in.dirty = true
+}
+
+func (in *InputData) Move(delta int) {
+	in.SetCursor(in.cursor + delta)
+}
+
+//WordLeft moves to the start of the previous word
+func (in *InputData) WordLeft() {
+	pos := in.cursor
+	for pos > 0 && unicode.IsSpace(in.text[pos-1]) {
+		pos--
+	}
+	for pos > 0 && !unicode.IsSpace(in.text[pos-1]) {
+		pos--
+	}
+	in.SetCursor(pos)
+}
+
+//WordRight moves past the end of the next word
+func (in *InputData) WordRight() {
+	pos := in.cursor
+	for pos < len(in.text) && unicode.IsSpace(in.text[pos]) {
+		pos++
+	}
+	for pos < len(in.text) && !unicode.IsSpace(in.text[pos]) {
+		pos++
+	}
+	in.SetCursor(pos)
+}
+
+//renderInput draws the input line, scrolled so the cursor is always visible
+func renderInput() {
+	in := &MainWin.input
+	if !in.dirty || MainWin.realWidth <= 0 || MainWin.font.size <= 0 {
+		return
+	}
+	in.dirty = false
+
+	ebitenLock.Lock()
+	defer ebitenLock.Unlock()
+
+	height := int(math.Round(MainWin.font.charHeight))
+	in.img = ebiten.NewImage(MainWin.realWidth, height)
+	in.img.Fill(inputBGColor)
+
+	//Leave one column for the left margin and one for the cursor
+	cols := int(float64(MainWin.realWidth)/MainWin.font.charWidth) - 2
+	if cols < 1 {
+		cols = 1
+	}
+	//Don't show what the user types while the server has echo (passwords)
+	_, tn := getCon()
+	hidden := tn != nil && tn.IsRemote(TELOPT_ECHO)
+
+	line, cursor := in.text, in.cursor
+	if MainWin.history.searching {
+		line, cursor = MainWin.history.SearchText()
+		hidden = false
+	}
+
+	//Wide characters take two columns, masked ones only one
+	width := func(r rune) int {
+		if hidden {
+			return 1
+		}
+		return runeWidth(r)
+	}
+	if in.scroll > len(line) {
+		in.scroll = len(line)
+	}
+	if cursor < in.scroll {
+		in.scroll = cursor
+	}
+	for {
+		used := 0
+		for _, r := range line[in.scroll:cursor] {
+			used += width(r)
+		}
+		if used <= cols || in.scroll >= cursor {
+			break
+		}
+		in.scroll++
+	}
+
+	x := 0
+	cursorX := -1
+	for i := in.scroll; i < len(line) && x < cols; i++ {
+		if i == cursor {
+			cursorX = x
+		}
+		c := string(line[i])
+		if hidden {
+			c = "*"
+		}
+		text.Draw(in.img, c,
+			MainWin.font.face,
+			int(math.Round(float64(x+1)*MainWin.font.charWidth)),
+			int(math.Round(MainWin.font.size)),
+			inputFGColor)
+		x += width(line[i])
+	}
+	if cursorX < 0 {
+		cursorX = x //Cursor at the end of the line
+	}
+
+	cx := float64(cursorX+1) * MainWin.font.charWidth
+	ebitenutil.DrawRect(in.img, cx, MainWin.font.vertSpace/2, 2, MainWin.font.size, inputCursorColor)
+}
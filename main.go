@@ -4,12 +4,12 @@ import (
 	_ "embed"
 	"fmt"
 	"log"
+	"math"
 	"sync"
 
 	_ "github.com/flopp/go-findfont"
 	"github.com/golang/freetype/truetype"
 	"github.com/hajimehoshi/ebiten"
-	"golang.org/x/image/font"
 )
 
 //Embeds
@@ -30,7 +30,17 @@ func main() {
 
 	game := &Game{}
 
-	if err := ebiten.RunGame(game); err != nil {
+	//Settings are registered in init(), so they can only be loaded now
+	LoadSettings()
+	AddLine(fmt.Sprintf("Type %shelp for client commands.\n\n", commandPrefix))
+	if startServer != "" {
+		Dial(startServer)
+	}
+	readNet()
+
+	err := ebiten.RunGame(game)
+	StopLog()
+	if err != nil && err != ErrQuit {
 		log.Fatal(err)
 	}
 
@@ -43,6 +53,16 @@ func (g *Game) Layout(outsideWidth, outsideHeight int) (int, int) {
 }
 
 func (g *Game) Update() error {
+	if quitRequested {
+		return ErrQuit
+	}
+	handleInput()
+	updateBlink(g.counter)
+	updateTheme()
+	updateNow()
+	renderInput()
+
+	g.counter++
 	return nil
 }
 
@@ -66,24 +86,14 @@ func init() {
 	MainWin.width = defaultWindowWidth
 	MainWin.height = defaultWindowHeight
 	MainWin.userScale = defaultUserScale
+	MainWin.repeatDelay = defaultRepeatDelay
+	MainWin.repeatInterval = defaultRepeatInterval
+	MainWin.input.dirty = true
 
 	//Init font
-	MainWin.font.size = defaultFontSize
-	MainWin.font.face = truetype.NewFace(tt, &truetype.Options{
-		Size:              float64(MainWin.font.size),
-		Hinting:           font.HintingFull,
-		GlyphCacheEntries: glyphCacheSize,
-	})
-
-	//Font setup
-	MainWin.font.vertSpace = MainWin.font.size / defaultVerticalSpace
-	MainWin.font.charWidth = MainWin.font.size / defaultHorizontalSpace
-	MainWin.font.charHeight = MainWin.font.size + MainWin.font.vertSpace
-
-	MainWin.lines.lines[0] = ""
-	MainWin.lines.pos = 0
-	MainWin.lines.head = 0
-	MainWin.lines.tail = 0
+	updateFont()
+
+	MainWin.lines.Resize(defaultScrollLines)
 
 	MainWin.dirty = false
 
@@ -110,8 +120,6 @@ func init() {
 			"Source: https://github.com/Distortions81/gomud-client\n" +
 			"\n")
 	updateNow() //Only call when needed
-	DialSSL(defaultServer)
-	readNet()
 }
 
 func (g *Game) Draw(screen *ebiten.Image) {
@@ -123,12 +131,13 @@ func (g *Game) Draw(screen *ebiten.Image) {
 		MainWin.realHeight = sy
 		MainWin.offScreen = ebiten.NewImage(sx, sy)
 
-		MainWin.dirty = false
-		for x := 0; x < MAX_SCROLL_LINES; x++ {
-			MainWin.lines.pixLines[x] = nil
-		}
+		MainWin.viewChanged = true
+		MainWin.lines.Rewrap()
+		MainWin.input.dirty = true
 		fmt.Println("Buffer resized.")
 		updateNow()
+		renderInput()
+		SendWindowSize()
 	}
 
 	if MainWin.dirty == true || clearEveryFrame {
@@ -137,5 +146,12 @@ func (g *Game) Draw(screen *ebiten.Image) {
 		op.Filter = ebiten.FilterNearest
 
 		screen.DrawImage(MainWin.offScreen, op)
+
+		if MainWin.input.img != nil {
+			op := &ebiten.DrawImageOptions{}
+			op.Filter = ebiten.FilterNearest
+			op.GeoM.Translate(0, float64(MainWin.realHeight)-math.Round(MainWin.font.charHeight))
+			screen.DrawImage(MainWin.input.img, op)
+		}
 	}
 }
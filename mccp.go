@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+//MCCP, Mud Client Compression Protocol
+const TELOPT_COMPRESS2 = 86 //Server to client
+const TELOPT_COMPRESS3 = 87 //Client to server
+
+//Byte counts for /netstats, wire is what went over the socket
+var netStats struct {
+	wireIn  int64
+	textIn  int64
+	wireOut int64
+	textOut int64
+	since   time.Time
+}
+
+func init() {
+	RegisterTelnetOption(&TelnetOption{
+		Code:   TELOPT_COMPRESS2,
+		Name:   "COMPRESS2",
+		Remote: true,
+		OnSub: func(t *Telnet, data []byte) {
+			//IAC SB COMPRESS2 IAC SE, everything after it is compressed
+			t.Stop()
+		},
+	})
+	RegisterTelnetOption(&TelnetOption{
+		Code:      TELOPT_COMPRESS3,
+		Name:      "COMPRESS3",
+		Remote:    true,
+		OnEnable:  func(t *Telnet, local bool) { t.startCompress() },
+		OnDisable: func(t *Telnet, local bool) { t.stopCompress() },
+	})
+	RegisterCommand(&Command{
+		Name: "netstats",
+		Help: "Show bytes sent and received, and how well compression is doing",
+		Run:  cmdNetStats,
+	})
+}
+
+//resetNetStats starts counting for a new connection, call with conLock held
+func resetNetStats() {
+	atomic.StoreInt64(&netStats.wireIn, 0)
+	atomic.StoreInt64(&netStats.textIn, 0)
+	atomic.StoreInt64(&netStats.wireOut, 0)
+	atomic.StoreInt64(&netStats.textOut, 0)
+	netStats.since = time.Now()
+}
+
+//countWriter counts what is written to the socket
+type countWriter struct {
+	w io.Writer
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(&netStats.wireOut, int64(n))
+	return n, err
+}
+
+//byteSource reads from the socket, after anything put back with unread.
+//It is a ByteReader so zlib reads exactly up to the end of its stream.
+type byteSource struct {
+	pending []byte
+	r       *bufio.Reader
+}
+
+func (s *byteSource) unread(data []byte) {
+	s.pending = append(append([]byte(nil), data...), s.pending...)
+}
+
+func (s *byteSource) Read(p []byte) (int, error) {
+	if len(s.pending) > 0 {
+		n := copy(p, s.pending)
+		s.pending = s.pending[n:]
+		return n, nil
+	}
+	n, err := s.r.Read(p)
+	atomic.AddInt64(&netStats.wireIn, int64(n))
+	return n, err
+}
+
+func (s *byteSource) ReadByte() (byte, error) {
+	if len(s.pending) > 0 {
+		c := s.pending[0]
+		s.pending = s.pending[1:]
+		return c, nil
+	}
+	c, err := s.r.ReadByte()
+	if err == nil {
+		atomic.AddInt64(&netStats.wireIn, 1)
+	}
+	return c, err
+}
+
+//NetReader reads from the connection, decompressing while MCCP2 is on
+type NetReader struct {
+	src *byteSource
+	z   io.ReadCloser
+	on  int32 //z != nil, for other goroutines
+}
+
+func NewNetReader(r io.Reader) *NetReader {
+	return &NetReader{src: &byteSource{r: bufio.NewReaderSize(r, MAX_INPUT_LENGTH)}}
+}
+
+func (n *NetReader) Read(p []byte) (int, error) {
+	for n.z != nil {
+		count, err := n.z.Read(p)
+		atomic.AddInt64(&netStats.textIn, int64(count))
+		if err == io.EOF {
+			//Server ended the stream, what follows is plain again
+			n.z.Close()
+			n.z = nil
+			atomic.StoreInt32(&n.on, 0)
+			AddLine("Server stopped compression.\r\n")
+		} else if err != nil {
+			n.z = nil
+			atomic.StoreInt32(&n.on, 0)
+			return count, fmt.Errorf("decompression failed: %w", err)
+		}
+		if count > 0 {
+			return count, nil
+		}
+	}
+
+	count, err := n.src.Read(p)
+	atomic.AddInt64(&netStats.textIn, int64(count))
+	return count, err
+}
+
+//StartDecompress switches to zlib, rest is what came after IAC SE in the last read.
+//Reads the zlib header, so it may block until the server sends it.
+func (n *NetReader) StartDecompress(rest []byte) error {
+	n.src.unread(rest)
+	z, err := zlib.NewReader(n.src)
+	if err != nil {
+		return fmt.Errorf("decompression failed: %w", err)
+	}
+	n.z = z
+	atomic.StoreInt32(&n.on, 1)
+	return nil
+}
+
+func (n *NetReader) Compressed() bool {
+	return atomic.LoadInt32(&n.on) == 1
+}
+
+//startCompress sends IAC SB COMPRESS3 IAC SE and compresses everything
+//after it (MCCP3). Both happen under outLock, so no plain text from
+//another goroutine can get between them.
+func (t *Telnet) startCompress() {
+	t.outLock.Lock()
+	defer t.outLock.Unlock()
+
+	if t.zout != nil || t.out == nil {
+		return
+	}
+	if err := t.writeLocked(subBytes(TELOPT_COMPRESS3, nil)); err != nil {
+		return
+	}
+	t.rawOut = t.out
+	t.zout = zlib.NewWriter(t.rawOut)
+	t.out = t.zout
+}
+
+func (t *Telnet) stopCompress() {
+	t.outLock.Lock()
+	defer t.outLock.Unlock()
+
+	if t.zout == nil {
+		return
+	}
+	//Close writes the end of the stream, the server goes back to plain text
+	t.zout.Close()
+	t.out = t.rawOut
+	t.zout = nil
+}
+
+func (t *Telnet) Compressing() bool {
+	t.outLock.Lock()
+	defer t.outLock.Unlock()
+
+	return t.zout != nil
+}
+
+//formatRatio shows how much smaller the wire bytes were
+func formatRatio(wire, text int64) string {
+	if text <= 0 || wire >= text {
+		return "none"
+	}
+	return fmt.Sprintf("%.1f%% saved", 100-float64(wire)*100/float64(text))
+}
+
+func cmdNetStats(args []string) error {
+	con, tn := getCon()
+	if con == nil {
+		return errors.New("not connected")
+	}
+
+	MainWin.conLock.Lock()
+	in, since := MainWin.netIn, netStats.since
+	MainWin.conLock.Unlock()
+
+	wireIn := atomic.LoadInt64(&netStats.wireIn)
+	textIn := atomic.LoadInt64(&netStats.textIn)
+	wireOut := atomic.LoadInt64(&netStats.wireOut)
+	textOut := atomic.LoadInt64(&netStats.textOut)
+
+	buf := fmt.Sprintf("Connected to %s for %s\r\n", MainWin.serverAddr, time.Since(since).Round(time.Second))
+	buf += fmt.Sprintf("  Received: %d bytes, %d on the wire (MCCP2 %s, %s)\r\n",
+		textIn, wireIn, FormatBool(in != nil && in.Compressed()), formatRatio(wireIn, textIn))
+	buf += fmt.Sprintf("  Sent:     %d bytes, %d on the wire (MCCP3 %s, %s)\r\n",
+		textOut, wireOut, FormatBool(tn.Compressing()), formatRatio(wireOut, textOut))
+	AddLine(buf)
+	return nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func compress(text string) string {
+	buf := &bytes.Buffer{}
+	z := zlib.NewWriter(buf)
+	z.Write([]byte(text))
+	z.Close()
+	return buf.String()
+}
+
+//readStream reads everything from r the way readNet does, returns the text
+func readStream(t *testing.T, r io.Reader) (string, *NetReader) {
+	t.Helper()
+
+	tn, _ := newTestTelnet()
+	tn.remote[TELOPT_COMPRESS2] = true
+	in := NewNetReader(r)
+
+	text := []byte{}
+	buf := make([]byte, MAX_INPUT_LENGTH)
+	for {
+		n, err := in.Read(buf)
+		out, _ := tn.Process(buf[:n])
+		text = append(text, out...)
+
+		if rest := tn.TakeRest(); rest != nil {
+			if err := in.StartDecompress(rest); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err == io.EOF {
+			return string(text), in
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMCCP2(t *testing.T) {
+	start := iac(TELNET_SB, TELOPT_COMPRESS2) + iac(TELNET_SE)
+
+	tests := []struct {
+		name   string
+		stream string
+		want   string
+	}{
+		{"plain", "hello", "hello"},
+		{"same read", "before " + start + compress("inside"), "before inside"},
+		{"ends", "before " + start + compress("inside") + " after", "before inside after"},
+		{"telnet inside", start + compress("a"+iac(TELNET_NOP)+"b") + "c", "abc"},
+		{"twice", start + compress("one ") + "two " + start + compress("three") + " four", "one two three four"},
+		{"empty stream", "a" + start + compress("") + "b", "ab"},
+	}
+
+	readers := []struct {
+		name string
+		wrap func(r io.Reader) io.Reader
+	}{
+		{"whole", func(r io.Reader) io.Reader { return r }},
+		{"one byte", iotest.OneByteReader},
+		{"half", iotest.HalfReader},
+	}
+
+	for _, tc := range tests {
+		for _, rd := range readers {
+			t.Run(tc.name+"/"+rd.name, func(t *testing.T) {
+				got, in := readStream(t, rd.wrap(bytes.NewReader([]byte(tc.stream))))
+				if got != tc.want {
+					t.Errorf("got %q, want %q", got, tc.want)
+				}
+				if in.Compressed() {
+					t.Error("still compressed after the stream ended")
+				}
+			})
+		}
+	}
+}
+
+func TestMCCP2Corrupt(t *testing.T) {
+	start := iac(TELNET_SB, TELOPT_COMPRESS2) + iac(TELNET_SE)
+	data := []byte(compress("some text to break"))
+	data[len(data)/2] ^= 0xFF
+
+	tn, _ := newTestTelnet()
+	tn.remote[TELOPT_COMPRESS2] = true
+	in := NewNetReader(bytes.NewReader(append([]byte(start), data...)))
+
+	buf := make([]byte, MAX_INPUT_LENGTH)
+	n, _ := in.Read(buf)
+	tn.Process(buf[:n])
+	if err := in.StartDecompress(tn.TakeRest()); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, err := in.Read(buf)
+		if err == io.EOF {
+			t.Fatal("corrupt stream read without an error")
+		}
+		if err != nil {
+			break
+		}
+	}
+}
+
+func TestMCCP3(t *testing.T) {
+	out := &bytes.Buffer{}
+	tn := NewTelnet("test.example", out)
+
+	tn.Send([]byte("plain "))
+	tn.startCompress()
+	if !tn.Compressing() {
+		t.Fatal("not compressing")
+	}
+	tn.Send([]byte("squeezed"))
+
+	//The server is told first, then each write is flushed so it can be read right away
+	start := "plain " + iac(TELNET_SB, TELOPT_COMPRESS3) + iac(TELNET_SE)
+	if !bytes.HasPrefix(out.Bytes(), []byte(start)) {
+		t.Fatalf("sent %q, want %q first", out.Bytes(), start)
+	}
+	sent := out.Len()
+	z, err := zlib.NewReader(bytes.NewReader(out.Bytes()[len(start):]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("squeezed"))
+	if _, err := io.ReadFull(z, buf); err != nil || string(buf) != "squeezed" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+
+	tn.stopCompress()
+	tn.Send([]byte(" after"))
+	if tn.Compressing() {
+		t.Fatal("still compressing")
+	}
+
+	data := out.Bytes()
+	if !bytes.HasPrefix(data, []byte("plain ")) || !bytes.HasSuffix(data, []byte(" after")) {
+		t.Fatalf("plain text not left alone: %q", data)
+	}
+	z, err = zlib.NewReader(bytes.NewReader(data[len(start) : len(data)-len(" after")]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := ioutil.ReadAll(z)
+	if err != nil || string(all) != "squeezed" {
+		t.Errorf("stream has %q, %v", all, err)
+	}
+	if out.Len() <= sent {
+		t.Error("stopping didn't end the stream")
+	}
+}
+
+//slowWriter takes a while per write like a busy socket, so the senders
+//queue up on outLock and it hands over to them in turn
+type slowWriter struct {
+	bytes.Buffer
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return w.Buffer.Write(p)
+}
+
+//Lines sent while MCCP3 starts must all end up on one side of IAC SB COMPRESS3 IAC SE
+func TestMCCP3Concurrent(t *testing.T) {
+	const senders, lines = 4, 5
+	start := []byte(iac(TELNET_SB, TELOPT_COMPRESS3) + iac(TELNET_SE))
+
+	for run := 0; run < 5; run++ {
+		out := &slowWriter{}
+		tn := NewTelnet("test.example", out)
+
+		//Start in the middle of the sending, so some land right around the switch
+		var sent int64
+		var wg sync.WaitGroup
+		for s := 0; s < senders; s++ {
+			wg.Add(1)
+			go func(s int) {
+				defer wg.Done()
+				for i := 0; i < lines; i++ {
+					tn.Send([]byte(fmt.Sprintf("line %d %d\n", s, i)))
+					atomic.AddInt64(&sent, 1)
+				}
+			}(s)
+		}
+		for atomic.LoadInt64(&sent) < 1 {
+			runtime.Gosched()
+		}
+		tn.startCompress()
+		wg.Wait()
+		tn.stopCompress()
+
+		data := out.Bytes()
+		pos := bytes.Index(data, start)
+		if pos < 0 {
+			t.Fatalf("no IAC SB COMPRESS3 IAC SE in %q", data)
+		}
+		z, err := zlib.NewReader(bytes.NewReader(data[pos+len(start):]))
+		if err != nil {
+			t.Fatalf("plain text after the switch: %v", err)
+		}
+		squeezed, err := ioutil.ReadAll(z)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := strings.Split(string(data[:pos])+string(squeezed), "\n")
+		if len(got)-1 != senders*lines {
+			t.Fatalf("got %d lines, want %d", len(got)-1, senders*lines)
+		}
+		for _, line := range got[:len(got)-1] {
+			if !strings.HasPrefix(line, "line ") {
+				t.Fatalf("garbled line %q", line)
+			}
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//MSDP, Mud Server Data Protocol
+const TELOPT_MSDP = 69
+
+const MSDP_VAR = 1
+const MSDP_VAL = 2
+const MSDP_TABLE_OPEN = 3
+const MSDP_TABLE_CLOSE = 4
+const MSDP_ARRAY_OPEN = 5
+const MSDP_ARRAY_CLOSE = 6
+
+//Variables we ask the server to keep us updated on
+var msdpReport = []string{"CHARACTER_NAME", "HEALTH", "HEALTH_MAX", "MANA", "MANA_MAX", "MOVEMENT", "MOVEMENT_MAX", "ROOM"}
+
+var msdpDebug = false
+
+func init() {
+	RegisterTelnetOption(&TelnetOption{
+		Code:      TELOPT_MSDP,
+		Name:      "MSDP",
+		Remote:    true,
+		OnEnable:  msdpEnable,
+		OnDisable: func(t *Telnet, local bool) { t.msdpClear() },
+		OnSub:     msdpSub,
+	})
+	RegisterSetting(&Setting{
+		Name: "msdpreport",
+		Help: "MSDP variables to ask the server to report, comma separated",
+		Get:  func() string { return strings.Join(msdpReport, ",") },
+		Set: func(val string) error {
+			msdpReport = []string{}
+			for _, name := range strings.Split(val, ",") {
+				if name = strings.ToUpper(strings.TrimSpace(name)); name != "" {
+					msdpReport = append(msdpReport, name)
+				}
+			}
+			return nil
+		},
+	})
+	RegisterSetting(&Setting{
+		Name: "msdpdebug",
+		Help: "Show MSDP variables from the server in the scrollback",
+		Get:  func() string { return FormatBool(msdpDebug) },
+		Set:  func(val string) error { return SetBool(&msdpDebug, val) },
+	})
+	RegisterCommand(&Command{
+		Name: "msdp",
+		Args: "[variable|report|unreport|send|list <names>]",
+		Help: "Show MSDP variables, or send an MSDP command to the server",
+		Run:  cmdMSDP,
+	})
+}
+
+func msdpEnable(t *Telnet, local bool) {
+	t.msdpClear()
+	SendMSDP(t, "LIST", "REPORTABLE_VARIABLES")
+	if len(msdpReport) > 0 {
+		SendMSDP(t, "REPORT", msdpReport...)
+	}
+}
+
+//msdpSub stores each variable and publishes it as an event
+func msdpSub(t *Telnet, data []byte) {
+	p := &msdpParser{data: data}
+	for p.pos < len(p.data) {
+		name, val, ok := p.variable()
+		if !ok {
+			break
+		}
+
+		t.lock.Lock()
+		if t.msdpVars == nil {
+			t.msdpVars = map[string]interface{}{}
+		}
+		t.msdpVars[strings.ToUpper(name)] = val
+		t.lock.Unlock()
+
+		if msdpDebug {
+			AddLine(fmt.Sprintf("MSDP: %s = %s\r\n", name, FormatMSDP(val)))
+		}
+		Publish(Event{Source: "msdp", Name: name, Data: val})
+	}
+}
+
+type msdpParser struct {
+	data []byte
+	pos  int
+}
+
+//variable reads VAR name VAL value, several VALs make an array
+func (p *msdpParser) variable() (string, interface{}, bool) {
+	if p.pos >= len(p.data) || p.data[p.pos] != MSDP_VAR {
+		return "", nil, false
+	}
+	p.pos++
+	name := p.text()
+
+	vals := []interface{}{}
+	for p.pos < len(p.data) && p.data[p.pos] == MSDP_VAL {
+		p.pos++
+		vals = append(vals, p.value())
+	}
+
+	switch len(vals) {
+	case 0:
+		return name, "", true
+	case 1:
+		return name, vals[0], true
+	}
+	return name, vals, true
+}
+
+func (p *msdpParser) value() interface{} {
+	if p.pos >= len(p.data) {
+		return ""
+	}
+
+	switch p.data[p.pos] {
+	case MSDP_TABLE_OPEN:
+		p.pos++
+		table := map[string]interface{}{}
+		for p.pos < len(p.data) && p.data[p.pos] != MSDP_TABLE_CLOSE {
+			name, val, ok := p.variable()
+			if !ok {
+				p.pos++ //Skip junk
+				continue
+			}
+			table[name] = val
+		}
+		p.pos++
+		return table
+
+	case MSDP_ARRAY_OPEN:
+		p.pos++
+		array := []interface{}{}
+		for p.pos < len(p.data) && p.data[p.pos] != MSDP_ARRAY_CLOSE {
+			if p.data[p.pos] != MSDP_VAL {
+				p.pos++ //Skip junk
+				continue
+			}
+			p.pos++
+			array = append(array, p.value())
+		}
+		p.pos++
+		return array
+	}
+	return p.text()
+}
+
+//text reads up to the next MSDP control byte
+func (p *msdpParser) text() string {
+	start := p.pos
+	for p.pos < len(p.data) && (p.data[p.pos] < MSDP_VAR || p.data[p.pos] > MSDP_ARRAY_CLOSE) {
+		p.pos++
+	}
+	return string(p.data[start:p.pos])
+}
+
+//SendMSDP sends VAR name VAL val..., used for REPORT, LIST, SEND and so on
+func SendMSDP(t *Telnet, name string, vals ...string) error {
+	if t == nil || !t.IsRemote(TELOPT_MSDP) {
+		return errors.New("MSDP is not enabled")
+	}
+
+	msg := append([]byte{MSDP_VAR}, name...)
+	for _, val := range vals {
+		msg = append(append(msg, MSDP_VAL), val...)
+	}
+	return t.SendSub(TELOPT_MSDP, msg)
+}
+
+//MSDPVar returns the current value of a variable on this connection
+func (t *Telnet) MSDPVar(name string) (interface{}, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	val, found := t.msdpVars[strings.ToUpper(name)]
+	return val, found
+}
+
+//MSDPNames lists the variables received on this connection
+func (t *Telnet) MSDPNames() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	names := make([]string, 0, len(t.msdpVars))
+	for name := range t.msdpVars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//FormatMSDP makes a value readable: text, [a, b] or {key: value}
+func FormatMSDP(val interface{}) string {
+	switch v := val.(type) {
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = FormatMSDP(item)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		parts := make([]string, len(keys))
+		for i, key := range keys {
+			parts[i] = key + ": " + FormatMSDP(v[key])
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	}
+	return fmt.Sprint(val)
+}
+
+func (t *Telnet) msdpClear() {
+	t.lock.Lock()
+	t.msdpVars = nil
+	t.lock.Unlock()
+}
+
+func cmdMSDP(args []string) error {
+	_, tn := getCon()
+	if len(args) == 0 {
+		names := []string{}
+		if tn != nil {
+			names = tn.MSDPNames()
+		}
+		if len(names) == 0 {
+			AddLine("No MSDP variables received.\r\n")
+			return nil
+		}
+		AddLine("MSDP variables: " + strings.Join(names, ", ") + "\r\n")
+		return nil
+	}
+
+	cmd := strings.ToUpper(args[0])
+	switch cmd {
+	case "REPORT", "UNREPORT", "SEND", "LIST", "RESET":
+		if len(args) < 2 {
+			return fmt.Errorf("%s needs at least one name", strings.ToLower(cmd))
+		}
+		names := make([]string, len(args)-1)
+		for i, name := range args[1:] {
+			names[i] = strings.ToUpper(name)
+		}
+		return SendMSDP(tn, cmd, names...)
+	}
+
+	if tn == nil {
+		return errors.New("not connected")
+	}
+	val, found := tn.MSDPVar(args[0])
+	if !found {
+		return fmt.Errorf("no %s received", args[0])
+	}
+	AddLine(fmt.Sprintf("%s = %s\r\n", strings.ToUpper(args[0]), FormatMSDP(val)))
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//msdp builds a message, % is VAR, = is VAL, {} a table and [] an array
+func msdp(s string) []byte {
+	return []byte(strings.NewReplacer(
+		"%", string(rune(MSDP_VAR)),
+		"=", string(rune(MSDP_VAL)),
+		"{", string(rune(MSDP_TABLE_OPEN)),
+		"}", string(rune(MSDP_TABLE_CLOSE)),
+		"[", string(rune(MSDP_ARRAY_OPEN)),
+		"]", string(rune(MSDP_ARRAY_CLOSE)),
+	).Replace(s))
+}
+
+//parseMSDP reads every variable in a message, like msdpSub
+func parseMSDP(data []byte) map[string]interface{} {
+	vars := map[string]interface{}{}
+	p := &msdpParser{data: data}
+	for p.pos < len(p.data) {
+		name, val, ok := p.variable()
+		if !ok {
+			break
+		}
+		vars[name] = val
+	}
+	return vars
+}
+
+type list = []interface{}
+type table = map[string]interface{}
+
+func TestMSDPParser(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want table
+	}{
+		{"empty", "", table{}},
+		{"one", "%HEALTH=100", table{"HEALTH": "100"}},
+		{"several", "%HEALTH=100%MANA=50", table{"HEALTH": "100", "MANA": "50"}},
+		{"no val", "%NAME", table{"NAME": ""}},
+		{"no val then var", "%NAME%HEALTH=1", table{"NAME": "", "HEALTH": "1"}},
+		{"empty val", "%NAME=", table{"NAME": ""}},
+		{"two vals", "%LIST=aa=bb", table{"LIST": list{"aa", "bb"}}},
+		{"array", "%LIST=[=aa=bb]", table{"LIST": list{"aa", "bb"}}},
+		{"empty array", "%LIST=[]", table{"LIST": list{}}},
+		{"table", "%ROOM={%VNUM=6008%NAME= The Square }", table{"ROOM": table{"VNUM": "6008", "NAME": " The Square "}}},
+		{"empty table", "%ROOM={}", table{"ROOM": table{}}},
+		{"nested",
+			"%ROOM={%EXITS={%n=6009%s=6010}%TAGS=[=indoors={%x=1}]}%HEALTH=5",
+			table{
+				"ROOM": table{
+					"EXITS": table{"n": "6009", "s": "6010"},
+					"TAGS":  list{"indoors", table{"x": "1"}},
+				},
+				"HEALTH": "5",
+			},
+		},
+		{"junk in table", "%ROOM={]junk%NAME=x}%HEALTH=1", table{"ROOM": table{"NAME": "x"}, "HEALTH": "1"}},
+		{"junk in array", "%LIST=[junk=x{]%HEALTH=1", table{"LIST": list{"x"}, "HEALTH": "1"}},
+		{"junk before var", "junk%HEALTH=1", table{}},
+		{"unterminated table", "%ROOM={%NAME=x", table{"ROOM": table{"NAME": "x"}}},
+		{"unterminated array", "%LIST=[=x=y", table{"LIST": list{"x", "y"}}},
+		{"unterminated nested", "%ROOM={%TAGS=[=", table{"ROOM": table{"TAGS": list{""}}}},
+		{"cut after name", "%HEALTH=1%MANA", table{"HEALTH": "1", "MANA": ""}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := parseMSDP(msdp(tc.in))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %s, want %s", FormatMSDP(got), FormatMSDP(tc.want))
+			}
+		})
+	}
+}
+
+func TestFormatMSDP(t *testing.T) {
+	val := table{"b": list{"1", "2"}, "a": table{"x": "y"}}
+	if got := FormatMSDP(val); got != "{a: {x: y}, b: [1, 2]}" {
+		t.Errorf("FormatMSDP = %q", got)
+	}
+}
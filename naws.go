@@ -0,0 +1,46 @@
+package main
+
+//NAWS, Negotiate About Window Size, RFC 1073
+const TELOPT_NAWS = 31
+
+func init() {
+	RegisterTelnetOption(&TelnetOption{
+		Code:  TELOPT_NAWS,
+		Name:  "NAWS",
+		Local: true,
+		OnEnable: func(t *Telnet, local bool) {
+			t.lock.Lock()
+			t.nawsCols, t.nawsRows = 0, 0
+			t.lock.Unlock()
+			t.sendWindowSize(wrapCols(), visibleRows())
+		},
+	})
+}
+
+//SendWindowSize tells the server how many columns and rows we show,
+//call after a resize or font change
+func SendWindowSize() {
+	_, tn := getCon()
+	if tn == nil {
+		return
+	}
+	tn.sendWindowSize(wrapCols(), visibleRows())
+}
+
+//sendWindowSize sends the size if NAWS is on and it changed since the last time
+func (t *Telnet) sendWindowSize(cols, rows int) {
+	if !t.IsLocal(TELOPT_NAWS) || cols <= 0 || rows <= 0 {
+		return
+	}
+
+	t.lock.Lock()
+	if cols == t.nawsCols && rows == t.nawsRows {
+		t.lock.Unlock()
+		return
+	}
+	t.nawsCols, t.nawsRows = cols, rows
+	t.lock.Unlock()
+
+	//16 bit width and height, SendSub escapes any 255 bytes
+	t.SendSub(TELOPT_NAWS, []byte{byte(cols >> 8), byte(cols), byte(rows >> 8), byte(rows)})
+}
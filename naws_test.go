@@ -0,0 +1,96 @@
+package main
+
+import "testing"
+
+func nawsSubBytes(size ...byte) string {
+	return iac(TELNET_SB, TELOPT_NAWS) + raw(size...) + iac(TELNET_SE)
+}
+
+func TestNAWSEncoding(t *testing.T) {
+	tests := []struct {
+		name       string
+		cols, rows int
+		want       string
+	}{
+		{"small", 80, 24, nawsSubBytes(0, 80, 0, 24)},
+		{"big endian", 300, 258, nawsSubBytes(1, 44, 1, 2)},
+		{"255 doubled", 255, 24, nawsSubBytes(0, 255, 255, 0, 24)},
+		{"255 high byte", 65280, 255, nawsSubBytes(255, 255, 0, 0, 255, 255)},
+		{"zero cols", 0, 24, ""},
+		{"zero rows", 80, 0, ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tn, out := newTestTelnet()
+			tn.local[TELOPT_NAWS] = true
+
+			tn.sendWindowSize(tc.cols, tc.rows)
+			if out.String() != tc.want {
+				t.Errorf("sent %v, want %v", out.Bytes(), []byte(tc.want))
+			}
+		})
+	}
+}
+
+func TestNAWSOnlyChanges(t *testing.T) {
+	tn, out := newTestTelnet()
+
+	//Nothing before the server agrees to NAWS
+	tn.sendWindowSize(80, 24)
+	if out.Len() != 0 {
+		t.Fatalf("sent %v with NAWS off", out.Bytes())
+	}
+	tn.local[TELOPT_NAWS] = true
+
+	steps := []struct {
+		cols, rows int
+		want       string
+	}{
+		{80, 24, nawsSubBytes(0, 80, 0, 24)},
+		{80, 24, ""},
+		{100, 24, nawsSubBytes(0, 100, 0, 24)},
+		{100, 30, nawsSubBytes(0, 100, 0, 30)},
+		{100, 30, ""},
+		{80, 24, nawsSubBytes(0, 80, 0, 24)},
+	}
+	for i, step := range steps {
+		out.Reset()
+		tn.sendWindowSize(step.cols, step.rows)
+		if out.String() != step.want {
+			t.Errorf("step %d: sent %v, want %v", i, out.Bytes(), []byte(step.want))
+		}
+	}
+
+	//A new connection hasn't been told anything yet
+	other, otherOut := newTestTelnet()
+	other.local[TELOPT_NAWS] = true
+	other.sendWindowSize(80, 24)
+	if otherOut.String() != nawsSubBytes(0, 80, 0, 24) {
+		t.Errorf("new connection sent %v", otherOut.Bytes())
+	}
+}
+
+func TestNAWSEnable(t *testing.T) {
+	height, charHeight := MainWin.realHeight, MainWin.font.charHeight
+	defer func() { MainWin.realHeight, MainWin.font.charHeight = height, charHeight }()
+
+	//80 columns, a row per pixel with one row for the input line
+	setWrapCols(t, 80)
+	MainWin.realHeight, MainWin.font.charHeight = 25, 1
+
+	tn, out := newTestTelnet()
+	tn.Process([]byte(iac(TELNET_DO, TELOPT_NAWS)))
+	want := iac(TELNET_WILL, TELOPT_NAWS) + nawsSubBytes(0, 80, 0, 24)
+	if out.String() != want {
+		t.Fatalf("sent %v, want %v", out.Bytes(), []byte(want))
+	}
+
+	//Turned off and on again, the size is sent again
+	out.Reset()
+	tn.Process([]byte(iac(TELNET_DONT, TELOPT_NAWS) + iac(TELNET_DO, TELOPT_NAWS)))
+	want = iac(TELNET_WONT, TELOPT_NAWS) + iac(TELNET_WILL, TELOPT_NAWS) + nawsSubBytes(0, 80, 0, 24)
+	if out.String() != want {
+		t.Errorf("sent %v, want %v", out.Bytes(), []byte(want))
+	}
+}
@@ -4,20 +4,101 @@ import (
 	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
+	"strings"
 	"time"
 )
 
-func DialSSL(addr string) {
+//Connection modes, picked from the scheme on the server address
+const CON_MODE_TLS = 0   //No scheme, tls:// or ssl://
+const CON_MODE_AUTO = 1  //auto://, try TLS first, fall back to plain telnet
+const CON_MODE_PLAIN = 2 //telnet:// or tcp://
 
-	buf := fmt.Sprintf("Connecting to: %s\r\n", addr)
+//ParseServerAddr splits an optional scheme off a server address
+func ParseServerAddr(addr string) (string, int) {
+	addr = strings.TrimSpace(addr)
+
+	if pos := strings.Index(addr, "://"); pos > 0 {
+		scheme := strings.ToLower(addr[:pos])
+		host := addr[pos+3:]
+
+		switch scheme {
+		case "tls", "ssl":
+			return host, CON_MODE_TLS
+		case "auto":
+			return host, CON_MODE_AUTO
+		case "telnet", "tcp":
+			return host, CON_MODE_PLAIN
+		}
+	}
+	return addr, CON_MODE_TLS
+}
+
+func ConModeName(mode int) string {
+	switch mode {
+	case CON_MODE_AUTO:
+		return "auto"
+	case CON_MODE_PLAIN:
+		return "plain"
+	}
+	return "TLS"
+}
+
+//Dial starts connecting to a server in the background, addr may carry a
+//tls://, auto:// or telnet:// scheme. Call from the main goroutine, the history,
+//theme and colors of the server are switched before it returns.
+func Dial(addr string) {
+	MainWin.conLock.Lock()
+	if MainWin.connecting {
+		MainWin.conLock.Unlock()
+		AddLine("Already connecting, please wait.\r\n")
+		return
+	}
+	MainWin.connecting = true
+	MainWin.conLock.Unlock()
+
+	Disconnect()
+
+	MainWin.conLock.Lock()
+	MainWin.serverAddr = addr
+	MainWin.conLock.Unlock()
+	MainWin.history.Load(ProfileName(addr))
+	SelectTheme(addr)
+	ResetANSI()
+
+	go dialServer(addr)
+}
+
+func dialServer(addr string) {
+	defer func() {
+		MainWin.conLock.Lock()
+		MainWin.connecting = false
+		MainWin.conLock.Unlock()
+	}()
+
+	host, mode := ParseServerAddr(addr)
+
+	buf := fmt.Sprintf("Connecting to: %s (%s)\r\n", host, ConModeName(mode))
 	AddLine(buf)
 
-	//Todo, allow timeout adjustment and connection canceling.
-	conf := &tls.Config{
-		InsecureSkipVerify: true,
+	var conn net.Conn
+	var err error
+
+	switch mode {
+	case CON_MODE_TLS:
+		conn, err = DialSSL(host)
+	case CON_MODE_PLAIN:
+		conn, err = DialPlain(host)
+	case CON_MODE_AUTO:
+		conn, err = DialSSL(host)
+		//Never fall back to plain text because a certificate was bad, or for
+		//a server that had TLS before, a failed handshake may be an attacker
+		if err != nil && !IsCertError(err) && !HasKnownCert(host) {
+			AddLine(fmt.Sprintf("TLS failed (%s), trying plain telnet. This connection is NOT encrypted.\r\n", err))
+			conn, err = DialPlain(host)
+		}
 	}
 
-	conn, err := tls.Dial("tcp", addr, conf)
 	if err != nil {
 		log.Println(err)
 
@@ -25,25 +106,136 @@ func DialSSL(addr string) {
 		AddLine(buf)
 		return
 	}
-	MainWin.sslCon = conn
+
+	MainWin.conLock.Lock()
+	if tc, ok := conn.(*tls.Conn); ok {
+		MainWin.conTLS = true
+		AddLine(fmt.Sprintf("Connected with %s.\r\n", tls.VersionName(tc.ConnectionState().Version)))
+	} else {
+		MainWin.conTLS = false
+	}
+	resetNetStats()
+	MainWin.telnet = NewTelnet(host, &countWriter{w: conn})
+	MainWin.netIn = NewNetReader(conn)
+	MainWin.con = conn
+	MainWin.isConnected = true
+	MainWin.conLock.Unlock()
+}
+
+//Disconnect closes the connection on purpose, so no "lost connection" message
+func Disconnect() bool {
+	MainWin.conLock.Lock()
+	con, addr := MainWin.con, MainWin.serverAddr
+	MainWin.con = nil
+	MainWin.isConnected = false
+	MainWin.conLock.Unlock()
+
+	if con == nil {
+		return false
+	}
+	con.Close()
+	AddLine(fmt.Sprintf("Disconnected from %s.\r\n", addr))
+	return true
+}
+
+//getCon returns the current connection and its telnet state, nil if not connected
+func getCon() (net.Conn, *Telnet) {
+	MainWin.conLock.Lock()
+	defer MainWin.conLock.Unlock()
+
+	if MainWin.con == nil {
+		return nil, nil
+	}
+	return MainWin.con, MainWin.telnet
+}
+
+func DialSSL(addr string) (net.Conn, error) {
+	//Todo, allow connection canceling.
+	conf := TLSConfig(addr)
+
+	dialer := &net.Dialer{Timeout: CONNECT_TIMEOUT_SEC * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, conf)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func DialPlain(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, CONNECT_TIMEOUT_SEC*time.Second)
+}
+
+//SendLine sends one line of user input, echoing it unless the server does
+func SendLine(line string) {
+	_, tn := getCon()
+	if tn == nil {
+		AddLine("Not connected.\r\n")
+		return
+	}
+
+	if localEcho && !tn.IsRemote(TELOPT_ECHO) {
+		AddLine(line + "\r\n")
+	}
+	err := tn.Send(tn.Charset().Encode(line + "\r\n"))
+	if err != nil {
+		AddLine(fmt.Sprintf("Send failed: %s\r\n", err))
+	}
+}
+
+//addServerData passes text on for display, ending prompts where the server sent GA or EOR
+func addServerData(tn *Telnet, data []byte, prompts []int) {
+	start := 0
+	for _, pos := range prompts {
+		if pos > start {
+			AddServerText(tn.Charset().Decode(data[start:pos]))
+		}
+		EndPrompt()
+		start = pos
+	}
+	if start < len(data) {
+		AddServerText(tn.Charset().Decode(data[start:]))
+	}
 }
 
 func readNet() {
 	go func() {
 		for {
 			buf := make([]byte, MAX_INPUT_LENGTH)
-			if MainWin.sslCon != nil {
-				n, err := MainWin.sslCon.Read(buf)
+			MainWin.conLock.Lock()
+			con, tn, in, addr := MainWin.con, MainWin.telnet, MainWin.netIn, MainWin.serverAddr
+			MainWin.conLock.Unlock()
+
+			if con != nil {
+				n, err := in.Read(buf)
 				if err != nil {
 					log.Println(n, err)
-					MainWin.sslCon.Close()
+					con.Close()
+
+					//Only complain if this wasn't closed by Disconnect
+					MainWin.conLock.Lock()
+					lost := MainWin.con == con
+					if lost {
+						MainWin.con = nil
+						MainWin.isConnected = false
+					}
+					MainWin.conLock.Unlock()
+
+					if lost {
+						buf := fmt.Sprintf("Lost connection to %s: %s\r\n", addr, err)
+						AddLine(buf)
+					}
+				}
+				//Strip and answer telnet commands before the text is displayed
+				newData, prompts := tn.Process(buf[:n])
+				addServerData(tn, newData, prompts)
 
-					buf := fmt.Sprintf("Lost connection to %s: %s\r\n", MainWin.serverAddr, err)
-					AddLine(buf)
-					MainWin.sslCon = nil
+				//MCCP2 started, the rest of what we read is compressed
+				if rest := tn.TakeRest(); rest != nil {
+					if err := in.StartDecompress(rest); err != nil {
+						AddLine(fmt.Sprintf("%s\r\n", err))
+						Disconnect()
+					}
 				}
-				newData := string(buf[:n])
-				AddLine(newData)
 			}
 			time.Sleep(time.Millisecond * NET_POLL_MS)
 		}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestParseServerAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		host string
+		mode int
+	}{
+		{"mud.example:4000", "mud.example:4000", CON_MODE_TLS},
+		{" mud.example:4000 ", "mud.example:4000", CON_MODE_TLS},
+		{"tls://mud.example:4000", "mud.example:4000", CON_MODE_TLS},
+		{"SSL://mud.example:4000", "mud.example:4000", CON_MODE_TLS},
+		{"auto://mud.example:4000", "mud.example:4000", CON_MODE_AUTO},
+		{"telnet://mud.example:4000", "mud.example:4000", CON_MODE_PLAIN},
+		{"tcp://mud.example:4000", "mud.example:4000", CON_MODE_PLAIN},
+		{"ftp://mud.example:4000", "ftp://mud.example:4000", CON_MODE_TLS},
+	}
+
+	for _, tc := range tests {
+		host, mode := ParseServerAddr(tc.addr)
+		if host != tc.host || mode != tc.mode {
+			t.Errorf("ParseServerAddr(%q) = %q, %s, want %q, %s",
+				tc.addr, host, ConModeName(mode), tc.host, ConModeName(tc.mode))
+		}
+	}
+}
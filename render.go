@@ -1,83 +1,198 @@
 package main
 
 import (
+	"fmt"
 	"image/color"
 	"math"
-	"strconv"
 
 	"github.com/hajimehoshi/ebiten"
+	"github.com/hajimehoshi/ebiten/ebitenutil"
 	"github.com/hajimehoshi/ebiten/text"
 )
 
-func renderOffscreen() {
+var moreBGColor = color.RGBA{0x00, 0x40, 0x80, 0xFF}
+var moreFGColor = color.RGBA{0xFF, 0xFF, 0xFF, 0xFF}
 
-	if MainWin.dirty == false { //Check for no pending frames, or we will re-render for no reason
-		ebitenLock.Lock()
-		defer ebitenLock.Unlock()
+//viewHeight is the height of the scrollback area, above the input line
+func viewHeight() float64 {
+	return float64(MainWin.realHeight) - math.Round(MainWin.font.charHeight)
+}
 
-		MainWin.offScreen.Clear()
-		//MainWin.offScreen.Fill(color.RGBA{0x30, 0x00, 0x00, 0xFF})
-
-		//Render our images out here
-		head := MainWin.lines.head
-		tail := MainWin.lines.tail
-		for a := tail; a <= head && a >= tail; a++ {
-
-			if MainWin.lines.pixLines[a] != nil {
-				op := &ebiten.DrawImageOptions{}
-				op.Filter = ebiten.FilterNearest
-				op.GeoM.Translate(0.0, float64(a)*MainWin.font.charHeight)
-				MainWin.offScreen.DrawImage(MainWin.lines.pixLines[a], op)
-			} else {
-				//Stop rendering here, lines after this are not yet ready.
-				return
-			}
+//visibleRows is how many lines fit in the scrollback area
+func visibleRows() int {
+	if MainWin.font.charHeight <= 0 {
+		return 0
+	}
+	rows := int(viewHeight() / MainWin.font.charHeight)
+	if rows < 0 {
+		rows = 0
+	} else if rows > MAX_VIEW_LINES {
+		rows = MAX_VIEW_LINES
+	}
+	return rows
+}
+
+//viewRange returns the oldest and newest line on screen,
+//and how many rows of the newest are hidden below the view.
+//The oldest is after the newest when there is nothing to show.
+func viewRange() (int, int, int) {
+	t := &MainWin.lines
+	skip := MainWin.scroll
+
+	//Skip lines that are entirely below the view
+	bottom := t.head
+	for bottom >= t.tail && skip >= t.LineRows(bottom) {
+		skip -= t.LineRows(bottom)
+		bottom--
+	}
+	//Empty scrollback, head isn't a line then
+	if bottom < t.tail {
+		return bottom + 1, bottom, 0
+	}
+
+	top := bottom
+	need := visibleRows() + skip
+	for top > t.tail {
+		need -= t.LineRows(top)
+		if need <= 0 {
+			break
 		}
-		MainWin.dirty = true
+		top--
+	}
+	return top, bottom, skip
+}
+
+//maxScroll is how far back we can scroll while still filling the screen
+func maxScroll() int {
+	max := MainWin.lines.rows - visibleRows()
+	if max < 0 {
+		return 0
 	}
+	return max
+}
+
+//clampScroll keeps the view inside the scrollback after it lost rows
+func clampScroll() {
+	if MainWin.scroll > maxScroll() {
+		MainWin.scroll = maxScroll()
+	}
+	if MainWin.newLines > MainWin.scroll {
+		MainWin.newLines = MainWin.scroll
+	}
+}
 
+//scrollView moves the view, positive is back in time
+func scrollView(delta int) {
+	setScroll(MainWin.scroll + delta)
+}
+
+func setScroll(pos int) {
+	if pos > maxScroll() {
+		pos = maxScroll()
+	}
+	if pos < 0 {
+		pos = 0
+	}
+	if pos == MainWin.scroll {
+		return
+	}
+
+	MainWin.scroll = pos
+	if pos == 0 {
+		MainWin.newLines = 0
+	}
+	MainWin.viewChanged = true
+	renderText()
+}
+
+func renderOffscreen() {
+	ebitenLock.Lock()
+	defer ebitenLock.Unlock()
+
+	MainWin.offScreen.Fill(ActiveColors().BG)
+
+	//Render our images out here, newest at the bottom
+	top, bottom, skip := viewRange()
+	y := viewHeight() + float64(skip)*MainWin.font.charHeight
+	for a := bottom; a >= top; a-- {
+		y -= float64(MainWin.lines.LineRows(a)) * MainWin.font.charHeight
+		if img := MainWin.lines.Image(a); img != nil {
+			op := &ebiten.DrawImageOptions{}
+			op.Filter = ebiten.FilterNearest
+			op.GeoM.Translate(0.0, math.Round(y))
+			MainWin.offScreen.DrawImage(img, op)
+		}
+	}
+
+	//Tell the user there is more to see
+	if MainWin.scroll > 0 && MainWin.font.charHeight > 0 {
+		msg := fmt.Sprintf("-- Scrolled back %d lines", MainWin.scroll)
+		if MainWin.newLines > 0 {
+			msg += fmt.Sprintf(", %d new below", MainWin.newLines)
+		}
+		msg += " (Ctrl+End to return) --"
+
+		barY := viewHeight() - math.Round(MainWin.font.charHeight)
+		ebitenutil.DrawRect(MainWin.offScreen, 0, barY, float64(MainWin.realWidth), math.Round(MainWin.font.charHeight), moreBGColor)
+		text.Draw(MainWin.offScreen, msg, MainWin.font.face,
+			int(math.Round(MainWin.font.charWidth)),
+			int(math.Round(barY+MainWin.font.size)),
+			moreFGColor)
+	}
+	MainWin.dirty = true
 }
 
 func renderText() {
 
 	didRender := false
 
-	head := MainWin.lines.head
-	tail := MainWin.lines.tail
-
-	//Render old to new, so color codes can persist lines
-	for a := tail; a <= head && a >= tail; a++ {
-		if MainWin.lines.pixLines[a] == nil {
-			MainWin.lines.pixLines[a] = renderLine(a)
+	//Only lines in view are rendered, the rest wait until scrolled to
+	top, bottom, _ := viewRange()
+	for a := top; a <= bottom; a++ {
+		if MainWin.lines.Image(a) == nil {
+			MainWin.lines.SetImage(a, renderLine(a))
 			didRender = true
 		}
-
 	}
 
-	//TODO: Optimize, only render if a line rendered falls within our viewport.
 	//We only render if there is something new to draw!
-	if didRender {
+	if didRender || MainWin.viewChanged {
+		MainWin.viewChanged = false
 		renderOffscreen()
 	}
 }
 
 func renderLine(pos int) *ebiten.Image {
 	if MainWin.realWidth > 0 && MainWin.font.size > 0 {
-		len := len(MainWin.lines.lines[pos])
+		line := MainWin.lines.Line(pos)
+		colors := MainWin.lines.Colors(pos)
+		wraps := MainWin.lines.Wraps(pos)
+		len := len(line)
 		ebitenLock.Lock()
 		defer ebitenLock.Unlock()
 
-		tempImg := ebiten.NewImage(MainWin.realWidth, int(math.Round(MainWin.font.size+MainWin.font.vertSpace)))
+		rows := MainWin.lines.LineRows(pos)
+		if rows < 1 {
+			rows = 1
+		}
+		tempImg := ebiten.NewImage(MainWin.realWidth, int(math.Round(float64(rows)*MainWin.font.charHeight)))
 		x := 0
-		for i := 0; i < len; i++ {
-			if strconv.IsPrint(rune(MainWin.lines.lines[pos][i])) && MainWin.lines.colors[pos][i] != ANSI_CONTROL {
-				x++
-				text.Draw(tempImg, string(MainWin.lines.lines[pos][i]),
-					MainWin.font.face,
-					int(math.Round(float64(x)*MainWin.font.charWidth)),
-					int(math.Round(MainWin.font.size)),
-					color.RGBA{MainWin.lines.colors[pos][i].Red, MainWin.lines.colors[pos][i].Green, MainWin.lines.colors[pos][i].Blue, 0xFF})
+		row := 0
+		for i := 0; i < len; {
+			//Next display row, wrapped rows get the hanging indent
+			if row+1 < rows && i >= wraps[row+1] {
+				row++
+				x = wrapIndent
+				if x > wrapCols()/2 {
+					x = wrapCols() / 2
+				}
+			}
+			size, width := nextCell(line, colors, i)
+			if width > 0 {
+				drawCell(tempImg, cellText(line, i, size), x+1, width, row, colors[i])
+				x += width
 			}
+			i += size
 		}
 		return tempImg
 	}
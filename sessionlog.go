@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var sessionLog *os.File
+var sessionLogLock sync.Mutex
+
+//StartLog begins writing received lines to a file, name defaults to logs/<server>-<date>.log
+func StartLog(name string) error {
+	sessionLogLock.Lock()
+	defer sessionLogLock.Unlock()
+
+	if sessionLog != nil {
+		return fmt.Errorf("already logging to %s", sessionLog.Name())
+	}
+	if name == "" {
+		profile := ProfileName(MainWin.serverAddr)
+		if profile == "" {
+			profile = "session"
+		}
+		name = ConfigPath(filepath.Join("logs", profile+"-"+time.Now().Format("2006-01-02-150405")+".log"))
+	}
+
+	file, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	sessionLog = file
+	fmt.Fprintf(sessionLog, "--- Log started %s ---\n", time.Now().Format(time.RFC1123))
+
+	AddLine(fmt.Sprintf("Logging to %s\r\n", name))
+	return nil
+}
+
+func StopLog() error {
+	sessionLogLock.Lock()
+	defer sessionLogLock.Unlock()
+
+	if sessionLog == nil {
+		return errors.New("not logging")
+	}
+	fmt.Fprintf(sessionLog, "--- Log stopped %s ---\n", time.Now().Format(time.RFC1123))
+	name := sessionLog.Name()
+	err := sessionLog.Close()
+	sessionLog = nil
+
+	AddLine(fmt.Sprintf("Stopped logging to %s\r\n", name))
+	return err
+}
+
+func LogFileName() string {
+	sessionLogLock.Lock()
+	defer sessionLogLock.Unlock()
+
+	if sessionLog == nil {
+		return ""
+	}
+	return sessionLog.Name()
+}
+
+//writeLog records one finished scrollback line
+func writeLog(line string) {
+	sessionLogLock.Lock()
+	defer sessionLogLock.Unlock()
+
+	if sessionLog == nil {
+		return
+	}
+	_, err := sessionLog.WriteString(strings.TrimRight(line, "\r") + "\n")
+	if err != nil {
+		sessionLog.Close()
+		sessionLog = nil
+		AddLine(fmt.Sprintf("Log write failed, logging stopped: %s\r\n", err))
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const settingsFile = "settings.json"
+
+//Setting is a user-adjustable value, shown and changed with /set
+type Setting struct {
+	Name string
+	Help string
+	Get  func() string
+	Set  func(val string) error
+}
+
+var settingsList = map[string]*Setting{}
+
+//Values from the settings file for settings that don't exist (yet), kept so we don't lose them
+var unknownSettings = map[string]string{}
+
+func init() {
+	RegisterSetting(&Setting{
+		Name: "prefix",
+		Help: "Character(s) that start a client command",
+		Get:  func() string { return commandPrefix },
+		Set: func(val string) error {
+			if val == "" || strings.ContainsAny(val, " \t") {
+				return errors.New("prefix must be non-empty and contain no spaces")
+			}
+			commandPrefix = val
+			return nil
+		},
+	})
+	RegisterSetting(&Setting{
+		Name: "server",
+		Help: "Server to connect to at startup, empty to not connect",
+		Get:  func() string { return startServer },
+		Set: func(val string) error {
+			startServer = val
+			return nil
+		},
+	})
+	RegisterSetting(&Setting{
+		Name: "localecho",
+		Help: "Show the lines you send in the scrollback",
+		Get:  func() string { return FormatBool(localEcho) },
+		Set:  func(val string) error { return SetBool(&localEcho, val) },
+	})
+	RegisterSetting(&Setting{
+		Name: "tlsverify",
+		Help: "strict: only trust system roots, tofu: pin unknown certificates on first use",
+		Get: func() string {
+			if tlsVerifyMode == TLS_VERIFY_STRICT {
+				return "strict"
+			}
+			return "tofu"
+		},
+		Set: func(val string) error {
+			switch strings.ToLower(val) {
+			case "strict":
+				tlsVerifyMode = TLS_VERIFY_STRICT
+			case "tofu":
+				tlsVerifyMode = TLS_VERIFY_TOFU
+			default:
+				return errors.New("must be strict or tofu")
+			}
+			return nil
+		},
+	})
+}
+
+func RegisterSetting(s *Setting) {
+	settingsList[strings.ToLower(s.Name)] = s
+}
+
+func GetSetting(name string) *Setting {
+	return settingsList[strings.ToLower(name)]
+}
+
+func SettingNames() []string {
+	names := make([]string, 0, len(settingsList))
+	for name := range settingsList {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//ParseBool accepts the usual ways of saying yes or no
+func ParseBool(val string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(val)) {
+	case "on", "yes", "true", "1", "enable", "enabled":
+		return true, nil
+	case "off", "no", "false", "0", "disable", "disabled":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q is not on or off", val)
+}
+
+func SetBool(dest *bool, val string) error {
+	b, err := ParseBool(val)
+	if err != nil {
+		return err
+	}
+	*dest = b
+	return nil
+}
+
+func FormatBool(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+//SetInt parses a number and checks it is within min and max
+func SetInt(dest *int, val string, min, max int) error {
+	n, err := strconv.Atoi(strings.TrimSpace(val))
+	if err != nil {
+		return fmt.Errorf("%q is not a number", val)
+	}
+	if n < min || n > max {
+		return fmt.Errorf("must be between %d and %d", min, max)
+	}
+	*dest = n
+	return nil
+}
+
+//LoadSettings applies the saved settings, call after every setting is registered
+func LoadSettings() {
+	saved := map[string]string{}
+	err := LoadJSON(settingsFile, &saved)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("settings:", err)
+			AddLine(fmt.Sprintf("Unable to load settings: %s\r\n", err))
+		}
+		return
+	}
+
+	for name, val := range saved {
+		s := GetSetting(name)
+		if s == nil {
+			unknownSettings[name] = val
+			continue
+		}
+		if err := s.Set(val); err != nil {
+			AddLine(fmt.Sprintf("Setting %s: %s\r\n", name, err))
+		}
+	}
+}
+
+func SaveSettings() {
+	out := map[string]string{}
+	for name, val := range unknownSettings {
+		out[name] = val
+	}
+	for name, s := range settingsList {
+		out[name] = s.Get()
+	}
+
+	err := SaveJSON(settingsFile, out)
+	if err != nil {
+		log.Println("settings:", err)
+		AddLine(fmt.Sprintf("Unable to save settings: %s\r\n", err))
+	}
+}
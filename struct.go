@@ -1,7 +1,7 @@
 package main
 
 import (
-	"crypto/tls"
+	"net"
 	"sync"
 
 	"github.com/hajimehoshi/ebiten"
@@ -9,7 +9,12 @@ import (
 )
 
 type Window struct {
-	sslCon      *tls.Conn
+	con         net.Conn
+	conTLS      bool
+	conLock     sync.Mutex
+	connecting  bool
+	telnet      *Telnet
+	netIn       *NetReader
 	serverAddr  string
 	isConnected bool
 
@@ -27,21 +32,46 @@ type Window struct {
 	repeatDelay    int
 	repeatInterval int
 
-	lines TextHistory
+	lines   TextHistory
+	input   InputData
+	history HistoryData
+	dirty   bool
+
+	scroll      int  //Rows scrolled back from the newest, 0 follows new text
+	newLines    int  //Lines that arrived while scrolled back
+	viewChanged bool //Offscreen needs a redraw even if no line was rendered
+}
+
+type InputData struct {
+	text   []rune
+	cursor int
+	scroll int //First rune shown, when the line is wider than the window
+
+	img   *ebiten.Image
 	dirty bool
 }
 
 type TextHistory struct {
+	//Text that hasn't made a full line yet, with a color per byte
 	rawText     string
+	rawColors   []ANSIData
 	rawTextLock sync.Mutex
+	rawChanged  bool
+	ansi        *ANSIDecoder //Color state of the server stream
+	afterPrompt bool         //Drop the newline after a GA/EOR prompt
+
+	provisional bool //Newest line is the unfinished rawText, replaced on the next update
 
-	lines    [MAX_SCROLL_LINES]string
-	colors   [MAX_SCROLL_LINES][]ANSIData
-	pixLines [MAX_SCROLL_LINES]*ebiten.Image
+	//Rotating buffers, a line with sequence number seq lives at seq % size
+	lines    []string
+	colors   [][]ANSIData
+	wraps    [][]int //Byte offsets where each display row starts
+	pixLines []*ebiten.Image
 
-	pos  int
-	head int
-	tail int
+	rows int //Display rows of all lines, after wrapping
+	size int //Lines kept
+	head int //Sequence number of the newest line
+	tail int //Sequence number of the oldest line, head+1 when empty
 }
 
 type FontData struct {
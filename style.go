@@ -0,0 +1,131 @@
+package main
+
+import (
+	"image/color"
+	"math"
+
+	"github.com/hajimehoshi/ebiten"
+	"github.com/hajimehoshi/ebiten/ebitenutil"
+	"github.com/hajimehoshi/ebiten/text"
+)
+
+const italicSkew = -0.21 //About 12 degrees
+
+var blinkEnabled = true
+var blinkHidden = false
+
+//Scratch image italic glyphs are drawn into before being sheared
+var italicImg *ebiten.Image
+
+func init() {
+	RegisterSetting(&Setting{
+		Name: "blink",
+		Help: "Animate blinking text, off shows it steadily",
+		Get:  func() string { return FormatBool(blinkEnabled) },
+		Set: func(val string) error {
+			if err := SetBool(&blinkEnabled, val); err != nil {
+				return err
+			}
+			blinkHidden = false
+			clearBlinkLines()
+			return nil
+		},
+	})
+}
+
+//cellColors works out the colors of a cell, with inverse applied
+func cellColors(c ANSIData) (color.RGBA, color.RGBA, bool) {
+	fg := c.DrawColor()
+	bg, hasBG := c.BackColor()
+
+	if c.Style&ANSI_STYLE_INVERSE != 0 {
+		if !hasBG {
+			bg = ActiveColors().BG
+		}
+		return bg, fg, true
+	}
+	return fg, bg, hasBG
+}
+
+//drawCell draws a character with its background and styles, x is the
+//column, width how many cells it takes and row the display row inside img
+func drawCell(img *ebiten.Image, s string, x, width, row int, c ANSIData) {
+	fg, bg, hasBG := cellColors(c)
+
+	left := math.Round(float64(x) * MainWin.font.charWidth)
+	right := math.Round(float64(x+width) * MainWin.font.charWidth)
+	top := math.Round(float64(row) * MainWin.font.charHeight)
+	baseline := math.Round(float64(row)*MainWin.font.charHeight + MainWin.font.size)
+
+	//Fill the cell first, so maps and status bars get their backgrounds
+	if hasBG {
+		ebitenutil.DrawRect(img, left, top, right-left, math.Round(MainWin.font.charHeight), bg)
+	}
+
+	if c.Style&ANSI_STYLE_BLINK != 0 && blinkEnabled && blinkHidden {
+		return
+	}
+
+	if c.Style&ANSI_STYLE_ITALIC != 0 {
+		drawItalic(img, s, width, left, baseline, fg)
+	} else {
+		text.Draw(img, s, MainWin.font.face, int(left), int(baseline), fg)
+	}
+
+	thick := math.Max(1, math.Round(MainWin.font.size/14))
+	if c.Style&ANSI_STYLE_UNDERLINE != 0 {
+		ebitenutil.DrawRect(img, left, baseline+thick, right-left, thick, fg)
+	}
+	if c.Style&ANSI_STYLE_STRIKE != 0 {
+		ebitenutil.DrawRect(img, left, math.Round(baseline-MainWin.font.size*0.3), right-left, thick, fg)
+	}
+}
+
+//drawItalic fakes an oblique face by shearing the glyph around its baseline
+func drawItalic(img *ebiten.Image, s string, width int, left, baseline float64, fg color.RGBA) {
+	w := int(math.Ceil(MainWin.font.charWidth * float64(width+1)))
+	h := int(math.Ceil(MainWin.font.charHeight))
+	if italicImg == nil {
+		italicImg = ebiten.NewImage(w, h)
+	} else if iw, ih := italicImg.Size(); iw != w || ih != h {
+		italicImg = ebiten.NewImage(w, h)
+	}
+	italicImg.Clear()
+
+	ascent := math.Round(MainWin.font.size)
+	text.Draw(italicImg, s, MainWin.font.face, 0, int(ascent), fg)
+
+	op := &ebiten.DrawImageOptions{}
+	op.Filter = ebiten.FilterLinear
+	op.GeoM.Translate(0, -ascent)
+	op.GeoM.Skew(italicSkew, 0)
+	op.GeoM.Translate(left, baseline)
+	img.DrawImage(italicImg, op)
+}
+
+//updateBlink flips blinking text about twice a second
+func updateBlink(tick uint64) {
+	if !blinkEnabled || tick%blinkTicks != 0 {
+		return
+	}
+	blinkHidden = !blinkHidden
+	clearBlinkLines()
+}
+
+//clearBlinkLines drops the images of lines on screen that have blinking text
+func clearBlinkLines() {
+	top, bottom, _ := viewRange()
+	found := false
+	for seq := top; seq <= bottom; seq++ {
+		for _, c := range MainWin.lines.Colors(seq) {
+			if c.Style&ANSI_STYLE_BLINK != 0 && c.Style&ANSI_STYLE_CONTROL == 0 {
+				MainWin.lines.SetImage(seq, nil)
+				found = true
+				break
+			}
+		}
+	}
+	if found {
+		renderText()
+	}
+}
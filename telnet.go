@@ -0,0 +1,464 @@
+package main
+
+import (
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//Telnet commands, RFC 854 / RFC 885
+const TELNET_EOR = 239
+const TELNET_SE = 240
+const TELNET_NOP = 241
+const TELNET_DM = 242
+const TELNET_BRK = 243
+const TELNET_IP = 244
+const TELNET_AO = 245
+const TELNET_AYT = 246
+const TELNET_EC = 247
+const TELNET_EL = 248
+const TELNET_GA = 249
+const TELNET_SB = 250
+const TELNET_WILL = 251
+const TELNET_WONT = 252
+const TELNET_DO = 253
+const TELNET_DONT = 254
+const TELNET_IAC = 255
+
+//Telnet options
+const TELOPT_ECHO = 1
+const TELOPT_SGA = 3
+const TELOPT_EOR = 25
+
+//Max size of a single subnegotiation, anything larger is dropped
+const MAX_SUBNEG_LENGTH = 64 * 1024
+
+//Parser states
+const (
+	telnetStateData = iota
+	telnetStateIAC
+	telnetStateOption
+	telnetStateSB
+	telnetStateSBData
+	telnetStateSBIAC
+)
+
+//TelnetOption describes how the client handles a single telnet option.
+//Local options are ones we perform (server sends DO), remote options
+//are ones we let the server perform (server sends WILL).
+type TelnetOption struct {
+	Code   byte
+	Name   string
+	Local  bool
+	Remote bool
+
+	OnEnable  func(t *Telnet, local bool)
+	OnDisable func(t *Telnet, local bool)
+	OnSub     func(t *Telnet, data []byte)
+}
+
+//Option registry, filled in by init() in the files that implement options
+var telnetOptions = map[byte]*TelnetOption{}
+
+const serverTelnetFile = "server_telnet.json"
+
+//Per-server overrides, host -> option name -> allowed, saved in serverTelnetFile
+var serverTelnetOptions map[string]map[string]bool
+var serverTelnetLock sync.Mutex
+
+type Telnet struct {
+	addr    string
+	out     io.Writer
+	outLock sync.Mutex
+
+	state  int
+	cmd    byte
+	sbOpt  byte
+	sbData []byte
+
+	lock          sync.Mutex
+	local         map[byte]bool //Options we are performing
+	remote        map[byte]bool //Options the server is performing
+	pendingLocal  map[byte]bool //We sent WILL, waiting for reply
+	pendingRemote map[byte]bool //We sent DO, waiting for reply
+
+	charset *Charset //Encoding of the text, see CHARSET
+
+	gmcpData map[string]json.RawMessage //Last GMCP message of each kind
+	msdpVars map[string]interface{}     //MSDP variables: string, []interface{} or map[string]interface{}
+
+	nawsCols, nawsRows int //Size last sent, so we only send changes
+	ttypeCount         int //How many times the server has asked for TTYPE
+
+	zout   *zlib.Writer //MCCP3, out writes through it while on
+	rawOut io.Writer
+
+	stopped bool //Stop was called, the rest of the input waits in rest
+	rest    []byte
+}
+
+func init() {
+	RegisterTelnetOption(&TelnetOption{Code: TELOPT_ECHO, Name: "ECHO", Remote: true})
+	RegisterTelnetOption(&TelnetOption{Code: TELOPT_SGA, Name: "SGA", Local: true, Remote: true})
+	RegisterTelnetOption(&TelnetOption{Code: TELOPT_EOR, Name: "EOR", Remote: true})
+}
+
+func RegisterTelnetOption(opt *TelnetOption) {
+	telnetOptions[opt.Code] = opt
+}
+
+//TelnetOptionByName looks up a registered option, case-insensitive
+func TelnetOptionByName(name string) *TelnetOption {
+	for _, opt := range telnetOptions {
+		if strings.EqualFold(opt.Name, name) {
+			return opt
+		}
+	}
+	return nil
+}
+
+func TelnetOptionName(code byte) string {
+	if opt := telnetOptions[code]; opt != nil {
+		return opt.Name
+	}
+	return fmt.Sprintf("%d", code)
+}
+
+func loadServerTelnetOptions() {
+	if serverTelnetOptions != nil {
+		return
+	}
+	serverTelnetOptions = map[string]map[string]bool{}
+
+	err := LoadJSON(serverTelnetFile, &serverTelnetOptions)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println("server telnet options:", err)
+	}
+}
+
+//SetServerTelnetOption enables or disables an option for one server address
+func SetServerTelnetOption(addr string, code byte, allowed bool) {
+	serverTelnetLock.Lock()
+	defer serverTelnetLock.Unlock()
+
+	loadServerTelnetOptions()
+	if serverTelnetOptions[addr] == nil {
+		serverTelnetOptions[addr] = map[string]bool{}
+	}
+	serverTelnetOptions[addr][TelnetOptionName(code)] = allowed
+
+	err := SaveJSON(serverTelnetFile, serverTelnetOptions)
+	if err != nil {
+		log.Println("server telnet options:", err)
+		AddLine(fmt.Sprintf("Unable to save telnet options: %s\r\n", err))
+	}
+}
+
+//ServerTelnetOption returns the override for an option on one server address,
+//found is false if there is none
+func ServerTelnetOption(addr string, code byte) (bool, bool) {
+	serverTelnetLock.Lock()
+	defer serverTelnetLock.Unlock()
+
+	loadServerTelnetOptions()
+	allowed, found := serverTelnetOptions[addr][TelnetOptionName(code)]
+	return allowed, found
+}
+
+func NewTelnet(addr string, out io.Writer) *Telnet {
+	return &Telnet{
+		addr:          addr,
+		out:           out,
+		charset:       defaultCharset,
+		state:         telnetStateData,
+		local:         map[byte]bool{},
+		remote:        map[byte]bool{},
+		pendingLocal:  map[byte]bool{},
+		pendingRemote: map[byte]bool{},
+	}
+}
+
+//Process strips telnet commands out of data read from the server,
+//answers negotiation, and returns the remaining text. GA and EOR mark the
+//end of a prompt, their positions in the text are returned as well.
+func (t *Telnet) Process(in []byte) ([]byte, []int) {
+	return t.process(in, make([]byte, 0, len(in)), nil)
+}
+
+func (t *Telnet) process(in, out []byte, prompts []int) ([]byte, []int) {
+	for i, c := range in {
+		switch t.state {
+		case telnetStateData:
+			if c == TELNET_IAC {
+				t.state = telnetStateIAC
+			} else {
+				out = append(out, c)
+			}
+
+		case telnetStateIAC:
+			switch c {
+			case TELNET_IAC: //Escaped 0xFF
+				out = append(out, c)
+				t.state = telnetStateData
+			case TELNET_WILL, TELNET_WONT, TELNET_DO, TELNET_DONT:
+				t.cmd = c
+				t.state = telnetStateOption
+			case TELNET_SB:
+				t.state = telnetStateSB
+			case TELNET_GA, TELNET_EOR:
+				prompts = append(prompts, len(out))
+				t.state = telnetStateData
+			default: //NOP, etc. Nothing to do
+				t.state = telnetStateData
+			}
+
+		case telnetStateOption:
+			t.negotiate(t.cmd, c)
+			t.state = telnetStateData
+
+		case telnetStateSB:
+			t.sbOpt = c
+			t.sbData = t.sbData[:0]
+			t.state = telnetStateSBData
+
+		case telnetStateSBData:
+			if c == TELNET_IAC {
+				t.state = telnetStateSBIAC
+			} else if len(t.sbData) < MAX_SUBNEG_LENGTH {
+				t.sbData = append(t.sbData, c)
+			}
+
+		case telnetStateSBIAC:
+			if c == TELNET_SE {
+				t.subnegotiation(t.sbOpt, t.sbData)
+				t.state = telnetStateData
+			} else if c == TELNET_IAC {
+				if len(t.sbData) < MAX_SUBNEG_LENGTH {
+					t.sbData = append(t.sbData, c)
+				}
+				t.state = telnetStateSBData
+			} else {
+				//Broken subnegotiation, treat as an IAC command
+				log.Printf("telnet: bad IAC %d inside SB %s\n", c, TelnetOptionName(t.sbOpt))
+				t.state = telnetStateIAC
+				out, prompts = t.process([]byte{c}, out, prompts)
+			}
+		}
+
+		if t.stopped {
+			t.rest = append(t.rest, in[i+1:]...)
+			break
+		}
+	}
+	return out, prompts
+}
+
+//Stop ends Process after the current command, for when the stream changes
+//(MCCP2). Only call from an option callback. The rest of the input is
+//returned by TakeRest.
+func (t *Telnet) Stop() {
+	t.stopped = true
+}
+
+//TakeRest returns the input left after Stop, nil if Process wasn't stopped
+func (t *Telnet) TakeRest() []byte {
+	if !t.stopped {
+		return nil
+	}
+	rest := t.rest
+	t.rest = nil
+	t.stopped = false
+	if rest == nil {
+		rest = []byte{}
+	}
+	return rest
+}
+
+//allowed reports if an option may be enabled in the given direction on this connection
+func (t *Telnet) allowed(code byte, local bool) bool {
+	opt := telnetOptions[code]
+	if opt == nil {
+		return false
+	}
+
+	if over, found := ServerTelnetOption(t.addr, code); found && !over {
+		return false
+	}
+
+	if local {
+		return opt.Local
+	}
+	return opt.Remote
+}
+
+func (t *Telnet) negotiate(cmd, code byte) {
+	local := cmd == TELNET_DO || cmd == TELNET_DONT
+	enable := cmd == TELNET_WILL || cmd == TELNET_DO
+
+	state, pending := t.remote, t.pendingRemote
+	yes, no := byte(TELNET_DO), byte(TELNET_DONT)
+	if local {
+		state, pending = t.local, t.pendingLocal
+		yes, no = TELNET_WILL, TELNET_WONT
+	}
+
+	t.lock.Lock()
+	wasOn := state[code]
+	asked := pending[code]
+	delete(pending, code)
+
+	changed := false
+	reply := byte(0)
+	if enable {
+		if wasOn {
+			//Already on, don't answer or we loop forever
+		} else if t.allowed(code, local) {
+			state[code] = true
+			changed = true
+			if !asked {
+				reply = yes
+			}
+		} else if !asked {
+			reply = no
+		}
+	} else if wasOn {
+		state[code] = false
+		changed = true
+		if !asked {
+			reply = no
+		}
+	}
+	t.lock.Unlock()
+
+	if reply != 0 {
+		t.SendCommand(reply, code)
+	}
+
+	if changed {
+		opt := telnetOptions[code]
+		if enable && opt.OnEnable != nil {
+			opt.OnEnable(t, local)
+		} else if !enable && opt.OnDisable != nil {
+			opt.OnDisable(t, local)
+		}
+	}
+}
+
+func (t *Telnet) subnegotiation(code byte, data []byte) {
+	opt := telnetOptions[code]
+	if opt == nil || opt.OnSub == nil {
+		return
+	}
+
+	t.lock.Lock()
+	active := t.local[code] || t.remote[code]
+	t.lock.Unlock()
+
+	//Ignore subnegotiations for options we never agreed to
+	if active {
+		//Copy, sbData is reused by the parser
+		opt.OnSub(t, append([]byte(nil), data...))
+	}
+}
+
+//RequestLocal offers to perform an option (WILL)
+func (t *Telnet) RequestLocal(code byte) {
+	t.lock.Lock()
+	if t.local[code] || t.pendingLocal[code] {
+		t.lock.Unlock()
+		return
+	}
+	t.pendingLocal[code] = true
+	t.lock.Unlock()
+
+	t.SendCommand(TELNET_WILL, code)
+}
+
+//RequestRemote asks the server to perform an option (DO)
+func (t *Telnet) RequestRemote(code byte) {
+	t.lock.Lock()
+	if t.remote[code] || t.pendingRemote[code] {
+		t.lock.Unlock()
+		return
+	}
+	t.pendingRemote[code] = true
+	t.lock.Unlock()
+
+	t.SendCommand(TELNET_DO, code)
+}
+
+func (t *Telnet) IsLocal(code byte) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.local[code]
+}
+
+func (t *Telnet) IsRemote(code byte) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.remote[code]
+}
+
+func (t *Telnet) write(data []byte) error {
+	t.outLock.Lock()
+	defer t.outLock.Unlock()
+
+	return t.writeLocked(data)
+}
+
+//writeLocked is write for callers that already hold outLock
+func (t *Telnet) writeLocked(data []byte) error {
+	if t.out == nil {
+		return io.ErrClosedPipe
+	}
+	_, err := t.out.Write(data)
+	if err == nil && t.zout != nil {
+		err = t.zout.Flush()
+	}
+	atomic.AddInt64(&netStats.textOut, int64(len(data)))
+	if err != nil {
+		log.Println("telnet write:", err)
+	}
+	return err
+}
+
+func (t *Telnet) SendCommand(cmd, code byte) error {
+	return t.write([]byte{TELNET_IAC, cmd, code})
+}
+
+//SendSub sends IAC SB <option> <data> IAC SE, data is escaped for us
+func (t *Telnet) SendSub(code byte, data []byte) error {
+	return t.write(subBytes(code, data))
+}
+
+func subBytes(code byte, data []byte) []byte {
+	buf := []byte{TELNET_IAC, TELNET_SB, code}
+	buf = append(buf, TelnetEscape(data)...)
+	return append(buf, TELNET_IAC, TELNET_SE)
+}
+
+//Send writes normal text to the server, escaping any 0xFF bytes
+func (t *Telnet) Send(data []byte) error {
+	return t.write(TelnetEscape(data))
+}
+
+//TelnetEscape doubles IAC bytes so they are sent as data
+func TelnetEscape(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for _, c := range data {
+		if c == TELNET_IAC {
+			out = append(out, TELNET_IAC)
+		}
+		out = append(out, c)
+	}
+	return out
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+//Option only used by the tests, records its subnegotiations
+const testTelopt = 99
+
+var testSubs [][]byte
+
+func init() {
+	RegisterTelnetOption(&TelnetOption{
+		Code:   testTelopt,
+		Name:   "TEST",
+		Local:  true,
+		Remote: true,
+		OnSub:  func(t *Telnet, data []byte) { testSubs = append(testSubs, data) },
+	})
+}
+
+func raw(b ...byte) string {
+	return string(b)
+}
+
+func iac(b ...byte) string {
+	return raw(append([]byte{TELNET_IAC}, b...)...)
+}
+
+//newTestTelnet returns a connection that writes its replies to out
+func newTestTelnet() (*Telnet, *bytes.Buffer) {
+	//No overrides, and don't read the user's config
+	serverTelnetOptions = map[string]map[string]bool{}
+	testSubs = nil
+
+	out := &bytes.Buffer{}
+	return NewTelnet("test.example", out), out
+}
+
+func TestTelnetProcess(t *testing.T) {
+	tests := []struct {
+		name    string
+		chunks  []string
+		text    string
+		prompts []int
+		subs    []string
+	}{
+		{"plain", []string{"hello"}, "hello", nil, nil},
+		{"escaped iac", []string{"a" + iac(TELNET_IAC) + "b"}, "a\xffb", nil, nil},
+		{"escaped iac split", []string{"a" + iac(), iac() + "b"}, "a\xffb", nil, nil},
+		{"nop dropped", []string{"a" + iac(TELNET_NOP) + "b"}, "ab", nil, nil},
+		{"ga prompt", []string{"hp> " + iac(TELNET_GA)}, "hp> ", []int{4}, nil},
+		{"ga and eor", []string{"a> " + iac(TELNET_GA) + "\r\nb> " + iac(TELNET_EOR)}, "a> \r\nb> ", []int{3, 8}, nil},
+		{"ga split", []string{"p>" + iac(), raw(TELNET_GA) + "x"}, "p>x", []int{2}, nil},
+		{"sb", []string{"a" + iac(TELNET_SB, testTelopt) + "hi" + iac(TELNET_SE) + "b"}, "ab", nil, []string{"hi"}},
+		{"sb split", []string{"a" + iac(TELNET_SB), raw(testTelopt) + "h", "i" + iac(), raw(TELNET_SE) + "b"}, "ab", nil, []string{"hi"}},
+		{"sb escaped iac", []string{iac(TELNET_SB, testTelopt) + "x" + iac(TELNET_IAC) + "y" + iac(TELNET_SE)}, "", nil, []string{"x\xffy"}},
+		{"sb bad iac", []string{iac(TELNET_SB, testTelopt) + "junk" + iac(TELNET_GA) + "text"}, "text", []int{0}, nil},
+		{"sb empty", []string{iac(TELNET_SB, testTelopt) + iac(TELNET_SE)}, "", nil, []string{""}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tn, _ := newTestTelnet()
+			tn.remote[testTelopt] = true
+
+			text := []byte{}
+			var prompts []int
+			for _, chunk := range tc.chunks {
+				out, p := tn.Process([]byte(chunk))
+				for _, pos := range p {
+					prompts = append(prompts, len(text)+pos)
+				}
+				text = append(text, out...)
+			}
+
+			if string(text) != tc.text {
+				t.Errorf("text %q, want %q", text, tc.text)
+			}
+			if !reflect.DeepEqual(prompts, tc.prompts) {
+				t.Errorf("prompts %v, want %v", prompts, tc.prompts)
+			}
+			subs := []string(nil)
+			for _, sub := range testSubs {
+				subs = append(subs, string(sub))
+			}
+			if !reflect.DeepEqual(subs, tc.subs) {
+				t.Errorf("subnegotiations %q, want %q", subs, tc.subs)
+			}
+		})
+	}
+}
+
+func TestTelnetSubNotAgreed(t *testing.T) {
+	tn, _ := newTestTelnet()
+	tn.Process([]byte(iac(TELNET_SB, testTelopt) + "hi" + iac(TELNET_SE)))
+	if len(testSubs) != 0 {
+		t.Errorf("got %q for an option that isn't on", testSubs)
+	}
+}
+
+func TestTelnetSubTooLong(t *testing.T) {
+	tn, _ := newTestTelnet()
+	tn.remote[testTelopt] = true
+
+	data := bytes.Repeat([]byte{'x'}, MAX_SUBNEG_LENGTH+10)
+	tn.Process([]byte(iac(TELNET_SB, testTelopt) + string(data) + iac(TELNET_SE) + "ok"))
+	if len(testSubs) != 1 || len(testSubs[0]) != MAX_SUBNEG_LENGTH {
+		t.Fatalf("subnegotiation not cut to %d bytes", MAX_SUBNEG_LENGTH)
+	}
+}
+
+func TestTelnetNegotiate(t *testing.T) {
+	requestEOR := func(tn *Telnet) { tn.RequestRemote(TELOPT_EOR) }
+
+	tests := []struct {
+		name    string
+		request func(tn *Telnet)
+		in      []string
+		code    byte
+		reply   string
+		remote  bool
+		local   bool
+	}{
+		{"will accepted", nil, []string{iac(TELNET_WILL, TELOPT_ECHO)}, TELOPT_ECHO, iac(TELNET_DO, TELOPT_ECHO), true, false},
+		{"will repeated", nil, []string{iac(TELNET_WILL, TELOPT_ECHO), iac(TELNET_WILL, TELOPT_ECHO)}, TELOPT_ECHO, iac(TELNET_DO, TELOPT_ECHO), true, false},
+		{"will then wont", nil, []string{iac(TELNET_WILL, TELOPT_ECHO), iac(TELNET_WONT, TELOPT_ECHO)}, TELOPT_ECHO, iac(TELNET_DO, TELOPT_ECHO) + iac(TELNET_DONT, TELOPT_ECHO), false, false},
+		{"wont when off", nil, []string{iac(TELNET_WONT, TELOPT_ECHO)}, TELOPT_ECHO, "", false, false},
+		{"will unknown", nil, []string{iac(TELNET_WILL, 123)}, 123, iac(TELNET_DONT, 123), false, false},
+		{"do unknown", nil, []string{iac(TELNET_DO, 123)}, 123, iac(TELNET_WONT, 123), false, false},
+		{"do remote only", nil, []string{iac(TELNET_DO, TELOPT_ECHO)}, TELOPT_ECHO, iac(TELNET_WONT, TELOPT_ECHO), false, false},
+		{"do accepted", nil, []string{iac(TELNET_DO, TELOPT_SGA)}, TELOPT_SGA, iac(TELNET_WILL, TELOPT_SGA), false, true},
+		{"do split", nil, []string{iac(), raw(TELNET_DO), raw(TELOPT_SGA)}, TELOPT_SGA, iac(TELNET_WILL, TELOPT_SGA), false, true},
+		{"requested accepted", requestEOR, []string{iac(TELNET_WILL, TELOPT_EOR)}, TELOPT_EOR, iac(TELNET_DO, TELOPT_EOR), true, false},
+		{"requested refused", requestEOR, []string{iac(TELNET_WONT, TELOPT_EOR)}, TELOPT_EOR, iac(TELNET_DO, TELOPT_EOR), false, false},
+		{"requested twice", func(tn *Telnet) { requestEOR(tn); requestEOR(tn) }, nil, TELOPT_EOR, iac(TELNET_DO, TELOPT_EOR), false, false},
+		{"local requested", func(tn *Telnet) { tn.RequestLocal(TELOPT_SGA) }, []string{iac(TELNET_DO, TELOPT_SGA)}, TELOPT_SGA, iac(TELNET_WILL, TELOPT_SGA), false, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tn, out := newTestTelnet()
+			if tc.request != nil {
+				tc.request(tn)
+			}
+			for _, chunk := range tc.in {
+				tn.Process([]byte(chunk))
+			}
+
+			if out.String() != tc.reply {
+				t.Errorf("sent %v, want %v", out.Bytes(), []byte(tc.reply))
+			}
+			if tn.IsRemote(tc.code) != tc.remote {
+				t.Errorf("remote %v, want %v", tn.IsRemote(tc.code), tc.remote)
+			}
+			if tn.IsLocal(tc.code) != tc.local {
+				t.Errorf("local %v, want %v", tn.IsLocal(tc.code), tc.local)
+			}
+		})
+	}
+}
+
+func TestTelnetServerRefused(t *testing.T) {
+	tn, out := newTestTelnet()
+	serverTelnetOptions["test.example"] = map[string]bool{"ECHO": false}
+
+	tn.Process([]byte(iac(TELNET_WILL, TELOPT_ECHO)))
+	if out.String() != iac(TELNET_DONT, TELOPT_ECHO) || tn.IsRemote(TELOPT_ECHO) {
+		t.Errorf("refused option was accepted, sent %v", out.Bytes())
+	}
+}
+
+func TestTelnetEscape(t *testing.T) {
+	got := TelnetEscape([]byte("a\xffb\xff"))
+	if string(got) != "a\xff\xffb\xff\xff" {
+		t.Errorf("TelnetEscape = %q", got)
+	}
+}
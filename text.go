@@ -1,34 +1,291 @@
 package main
 
 import (
+	"strconv"
 	"strings"
+
+	"github.com/hajimehoshi/ebiten"
 )
 
+//AddLine adds client text, its colors don't carry over to anything else
 func AddLine(text string) {
+	d := NewANSIDecoder()
+	text, colors := d.Decode(text)
+	rest, restColors := d.Flush()
 
-	go func() {
-		MainWin.lines.rawTextLock.Lock()
-		MainWin.lines.rawText += text
-		MainWin.lines.rawTextLock.Unlock()
-	}()
+	//No goroutine here, text must be appended in the order it arrived
+	MainWin.lines.rawTextLock.Lock()
+	MainWin.lines.rawText += text + rest
+	MainWin.lines.rawColors = append(append(MainWin.lines.rawColors, colors...), restColors...)
+	MainWin.lines.rawChanged = true
+	MainWin.lines.rawTextLock.Unlock()
+}
+
+//AddServerText adds text from the connection, which may end mid escape sequence
+func AddServerText(data string) {
+	MainWin.lines.rawTextLock.Lock()
+	defer MainWin.lines.rawTextLock.Unlock()
+
+	if MainWin.lines.ansi == nil {
+		MainWin.lines.ansi = NewANSIDecoder()
+	}
+	text, colors := MainWin.lines.ansi.Decode(data)
+
+	//The prompt already ended the line, don't add an empty one after it
+	for MainWin.lines.afterPrompt && len(text) > 0 {
+		if text[0] == '\r' {
+			text, colors = text[1:], colors[1:]
+			continue
+		}
+		if text[0] == '\n' {
+			text, colors = text[1:], colors[1:]
+		}
+		MainWin.lines.afterPrompt = false
+	}
+
+	MainWin.lines.rawText += text
+	MainWin.lines.rawColors = append(MainWin.lines.rawColors, colors...)
+	MainWin.lines.rawChanged = true
+}
+
+//EndPrompt finishes the pending text as a line, the server sent GA or EOR after it
+func EndPrompt() {
+	MainWin.lines.rawTextLock.Lock()
+	defer MainWin.lines.rawTextLock.Unlock()
+
+	t := &MainWin.lines
+	if t.rawText == "" || strings.HasSuffix(t.rawText, "\n") {
+		return
+	}
+	color := ANSI_DEFAULT
+	if t.ansi != nil {
+		color = t.ansi.Color()
+	}
+	t.rawText += "\n"
+	t.rawColors = append(t.rawColors, color)
+	t.rawChanged = true
+	t.afterPrompt = true
 }
 
+//ResetANSI starts a new connection with default colors
+func ResetANSI() {
+	MainWin.lines.rawTextLock.Lock()
+	MainWin.lines.ansi = NewANSIDecoder()
+	MainWin.lines.afterPrompt = false
+	MainWin.lines.rawTextLock.Unlock()
+}
+
+//textToLines moves complete lines into the scrollback. Text after the last
+//newline, usually a prompt, is shown as a provisional line that is replaced
+//when more text arrives.
 func textToLines() {
 	MainWin.lines.rawTextLock.Lock()
-	lines := strings.Split(MainWin.lines.rawText, "\n")
+	if !MainWin.lines.rawChanged {
+		MainWin.lines.rawTextLock.Unlock()
+		return
+	}
+	MainWin.lines.rawChanged = false
+
+	end := strings.LastIndex(MainWin.lines.rawText, "\n")
+	raw := MainWin.lines.rawText[:end+1]
+	rawColors := MainWin.lines.rawColors[:end+1]
+	rest := MainWin.lines.rawText[end+1:]
+	restColors := append([]ANSIData(nil), MainWin.lines.rawColors[end+1:]...)
+	MainWin.lines.rawText = rest
+	MainWin.lines.rawColors = restColors
 	MainWin.lines.rawTextLock.Unlock()
 
-	numLines := len(lines) - 1
-	if numLines > 0 {
+	x := 0
+	if MainWin.lines.provisional {
+		x -= MainWin.lines.DropNewest()
+		MainWin.lines.provisional = false
+	}
 
-		x := 0
-		for i := MainWin.lines.head + 1; i < MAX_SCROLL_LINES && x <= numLines; i++ {
-			MainWin.lines.lines[i] = lines[x]
-			MainWin.lines.colors[i] = AnsiColor(lines[x])
-			x++
+	start := 0
+	for i := 0; i < len(raw); i++ {
+		if raw[i] != '\n' {
+			continue
 		}
-		MainWin.lines.head += x
-		MainWin.lines.rawText = ""
-		updateNow()
+		//Colors get one extra entry, the color at the end of the line
+		line := raw[start:i]
+		x += MainWin.lines.Add(line, rawColors[start:i+1:i+1])
+		writeLog(MainWin.lines.PlainText(MainWin.lines.head))
+		start = i + 1
+	}
+
+	if rest != "" {
+		colors := append(restColors[:len(restColors):len(restColors)], restColors[len(restColors)-1])
+		x += MainWin.lines.Add(rest, colors)
+		MainWin.lines.provisional = true
+	}
+
+	//Keep the view still while scrolled back, and count what arrived
+	if MainWin.scroll > 0 && x != 0 {
+		MainWin.scroll += x
+		if MainWin.scroll < 0 {
+			MainWin.scroll = 0
+		}
+		if x > 0 {
+			MainWin.newLines += x
+		}
+		MainWin.viewChanged = true
+	}
+}
+
+//ClearLines empties the scrollback, sequence numbers keep counting up
+func ClearLines() {
+	MainWin.lines.tail = MainWin.lines.head + 1
+	MainWin.lines.provisional = false
+
+	//Bring the prompt back
+	MainWin.lines.rawTextLock.Lock()
+	if MainWin.lines.rawText != "" {
+		MainWin.lines.rawChanged = true
+	}
+	MainWin.lines.rawTextLock.Unlock()
+
+	MainWin.lines.Resize(MainWin.lines.size)
+	MainWin.scroll = 0
+	MainWin.newLines = 0
+	renderOffscreen()
+}
+
+func init() {
+	RegisterSetting(&Setting{
+		Name: "scrollback",
+		Help: "Lines of scrollback to keep",
+		Get:  func() string { return strconv.Itoa(MainWin.lines.size) },
+		Set: func(val string) error {
+			size := 0
+			if err := SetInt(&size, val, MIN_SCROLL_LINES, MAX_SCROLL_LINES); err != nil {
+				return err
+			}
+			MainWin.lines.Resize(size)
+
+			//Fewer rows may be left than we were scrolled back
+			clampScroll()
+			MainWin.viewChanged = true
+			return nil
+		},
+	})
+}
+
+//Resize changes how many lines are kept, keeping the newest.
+//Also used to set up an empty history.
+func (t *TextHistory) Resize(size int) {
+	lines := make([]string, size)
+	colors := make([][]ANSIData, size)
+	wraps := make([][]int, size)
+	pixLines := make([]*ebiten.Image, size)
+
+	if t.size == 0 {
+		t.head = 0
+		t.tail = 1
+	}
+	if t.tail < t.head-size+1 {
+		t.tail = t.head - size + 1
+	}
+	t.rows = 0
+	for seq := t.tail; seq <= t.head; seq++ {
+		old := seq % t.size
+		lines[seq%size] = t.lines[old]
+		colors[seq%size] = t.colors[old]
+		wraps[seq%size] = t.wraps[old]
+		pixLines[seq%size] = t.pixLines[old]
+		t.rows += len(t.wraps[old])
+	}
+
+	t.lines = lines
+	t.colors = colors
+	t.wraps = wraps
+	t.pixLines = pixLines
+	t.size = size
+}
+
+//Add stores a new line, dropping the oldest when full.
+//Returns how many display rows the line takes.
+func (t *TextHistory) Add(line string, colors []ANSIData) int {
+	t.head++
+	if t.head-t.tail >= t.size {
+		old := t.tail % t.size
+		t.rows -= len(t.wraps[old])
+		t.lines[old] = ""
+		t.colors[old] = nil
+		t.wraps[old] = nil
+		t.pixLines[old] = nil
+		t.tail++
+	}
+
+	pos := t.head % t.size
+	t.lines[pos] = line
+	t.colors[pos] = colors
+	t.wraps[pos] = wrapLine(line, colors, wrapCols(), wrapIndent)
+	t.pixLines[pos] = nil
+	t.rows += len(t.wraps[pos])
+	return len(t.wraps[pos])
+}
+
+//DropNewest removes the newest line, returns how many rows it took
+func (t *TextHistory) DropNewest() int {
+	if !t.Valid(t.head) {
+		return 0
+	}
+	pos := t.head % t.size
+	rows := len(t.wraps[pos])
+	t.rows -= rows
+	t.lines[pos] = ""
+	t.colors[pos] = nil
+	t.wraps[pos] = nil
+	t.pixLines[pos] = nil
+	t.head--
+	return rows
+}
+
+//Valid reports if a sequence number is still in the buffer
+func (t *TextHistory) Valid(seq int) bool {
+	return t.size > 0 && seq >= t.tail && seq <= t.head
+}
+
+func (t *TextHistory) Line(seq int) string {
+	if !t.Valid(seq) {
+		return ""
+	}
+	return t.lines[seq%t.size]
+}
+
+func (t *TextHistory) Colors(seq int) []ANSIData {
+	if !t.Valid(seq) {
+		return nil
+	}
+	return t.colors[seq%t.size]
+}
+
+//PlainText is a line without escape sequences or the carriage return,
+//for logging, searching and copying
+func (t *TextHistory) PlainText(seq int) string {
+	if !t.Valid(seq) {
+		return ""
+	}
+	pos := seq % t.size
+	return strings.TrimRight(PlainText(t.lines[pos], t.colors[pos]), "\r")
+}
+
+func (t *TextHistory) Image(seq int) *ebiten.Image {
+	if !t.Valid(seq) {
+		return nil
+	}
+	return t.pixLines[seq%t.size]
+}
+
+func (t *TextHistory) SetImage(seq int, img *ebiten.Image) {
+	if t.Valid(seq) {
+		t.pixLines[seq%t.size] = img
+	}
+}
+
+//ClearImages drops every cached line image, after a resize or font change
+func (t *TextHistory) ClearImages() {
+	for x := range t.pixLines {
+		t.pixLines[x] = nil
 	}
 }
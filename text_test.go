@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+//setWrapCols makes wrapCols return cols until the test ends, 0 turns wrapping off
+func setWrapCols(t *testing.T, cols int) {
+	width, charWidth := MainWin.realWidth, MainWin.font.charWidth
+	t.Cleanup(func() {
+		MainWin.realWidth, MainWin.font.charWidth = width, charWidth
+	})
+
+	MainWin.realWidth, MainWin.font.charWidth = 0, 0
+	if cols > 0 {
+		MainWin.realWidth, MainWin.font.charWidth = cols+2, 1
+	}
+}
+
+func newTestHistory(size int, lines ...string) *TextHistory {
+	h := &TextHistory{}
+	h.Resize(size)
+	for _, line := range lines {
+		h.Add(line, nil)
+	}
+	return h
+}
+
+//checkHistory compares the lines kept, oldest first, and the row count
+func checkHistory(t *testing.T, h *TextHistory, want []string, rows int) {
+	t.Helper()
+
+	got := []string{}
+	for seq := h.tail; seq <= h.head; seq++ {
+		got = append(got, h.Line(seq))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("lines %q, want %q", got, want)
+	}
+	if h.rows != rows {
+		t.Errorf("rows %d, want %d", h.rows, rows)
+	}
+}
+
+func TestTextHistoryEmpty(t *testing.T) {
+	setWrapCols(t, 0)
+	h := newTestHistory(4)
+
+	if h.tail != h.head+1 {
+		t.Errorf("tail %d, head %d, want tail = head+1", h.tail, h.head)
+	}
+	if h.Valid(h.head) || h.Line(h.head) != "" || h.LineRows(h.head) != 0 {
+		t.Error("head of an empty history is a line")
+	}
+	if rows := h.DropNewest(); rows != 0 {
+		t.Errorf("DropNewest on empty = %d, want 0", rows)
+	}
+	checkHistory(t, h, []string{}, 0)
+}
+
+func TestTextHistoryEvict(t *testing.T) {
+	setWrapCols(t, 0)
+	h := newTestHistory(3, "1", "2", "3", "4", "5")
+
+	checkHistory(t, h, []string{"3", "4", "5"}, 3)
+	if h.head != 5 || h.tail != 3 {
+		t.Errorf("head %d tail %d, want 5 and 3", h.head, h.tail)
+	}
+	if h.Valid(2) || h.Line(2) != "" {
+		t.Error("evicted line is still there")
+	}
+	if h.Valid(6) {
+		t.Error("line after head is valid")
+	}
+}
+
+func TestTextHistoryRows(t *testing.T) {
+	setWrapCols(t, 10)
+	h := newTestHistory(3)
+
+	tests := []struct {
+		line string
+		rows int
+		all  int
+	}{
+		{"short", 1, 1},
+		{"aaaa bbbb cccc", 2, 3},
+		{"aaaa bbbb cccc dddd eeee", 3, 6},
+		{"x", 1, 6}, //Evicts "short"
+		{"y", 1, 5}, //Evicts the 2 row line
+	}
+	for _, tc := range tests {
+		if rows := h.Add(tc.line, nil); rows != tc.rows {
+			t.Errorf("Add(%q) = %d rows, want %d", tc.line, rows, tc.rows)
+		}
+		if h.rows != tc.all {
+			t.Errorf("after %q rows = %d, want %d", tc.line, h.rows, tc.all)
+		}
+	}
+
+	if rows := h.DropNewest(); rows != 1 {
+		t.Errorf("DropNewest = %d, want 1", rows)
+	}
+	checkHistory(t, h, []string{"aaaa bbbb cccc dddd eeee", "x"}, 4)
+}
+
+func TestTextHistoryResize(t *testing.T) {
+	setWrapCols(t, 10)
+	h := newTestHistory(5, "1", "aaaa bbbb cccc", "3", "4", "5")
+
+	h.Resize(3)
+	checkHistory(t, h, []string{"3", "4", "5"}, 3)
+
+	h.Resize(6)
+	checkHistory(t, h, []string{"3", "4", "5"}, 3)
+
+	//Sequence numbers carry on after a resize
+	h.Add("aaaa bbbb cccc", nil)
+	h.Add("7", nil)
+	h.Add("8", nil)
+	h.Add("9", nil)
+	checkHistory(t, h, []string{"4", "5", "aaaa bbbb cccc", "7", "8", "9"}, 7)
+	if h.head != 9 {
+		t.Errorf("head %d, want 9", h.head)
+	}
+}
+
+func TestTextHistoryDropNewest(t *testing.T) {
+	setWrapCols(t, 0)
+	h := newTestHistory(3, "1", "2")
+
+	h.DropNewest()
+	h.DropNewest()
+	checkHistory(t, h, []string{}, 0)
+
+	//Dropping past the oldest does nothing
+	h.DropNewest()
+	h.Add("3", nil)
+	checkHistory(t, h, []string{"3"}, 1)
+}
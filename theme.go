@@ -0,0 +1,358 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const themeDir = "themes"
+const serverThemeFile = "server_themes.json"
+const defaultThemeName = "classic"
+
+//Theme is a named palette, theme files are JSON in the themes dir:
+//{"foreground": "#c0c0c0", "background": "#000000", "palette": ["#000000", ... 16 colors]}
+type Theme struct {
+	Name       string     `json:"-"`
+	Foreground string     `json:"foreground"`
+	Background string     `json:"background"`
+	Palette    [16]string `json:"palette"`
+}
+
+//Palette order is black, red, green, yellow, blue, magenta, cyan, light gray,
+//then the bright versions: dark gray, red ... white
+var builtinThemes = map[string]*Theme{
+	"classic": {
+		Foreground: "#ffffff", Background: "#000000",
+		Palette: [16]string{
+			"#000000", "#7f0000", "#007f00", "#7f7f00", "#00007f", "#7f007f", "#007f7f", "#aaaaaa",
+			"#555555", "#ff0000", "#00ff00", "#ffff00", "#0000ff", "#ff00ff", "#00ffff", "#ffffff",
+		},
+	},
+	"xterm": {
+		Foreground: "#e5e5e5", Background: "#000000",
+		Palette: [16]string{
+			"#000000", "#cd0000", "#00cd00", "#cdcd00", "#0000ee", "#cd00cd", "#00cdcd", "#e5e5e5",
+			"#7f7f7f", "#ff0000", "#00ff00", "#ffff00", "#5c5cff", "#ff00ff", "#00ffff", "#ffffff",
+		},
+	},
+	"vga": {
+		Foreground: "#aaaaaa", Background: "#000000",
+		Palette: [16]string{
+			"#000000", "#aa0000", "#00aa00", "#aa5500", "#0000aa", "#aa00aa", "#00aaaa", "#aaaaaa",
+			"#555555", "#ff5555", "#55ff55", "#ffff55", "#5555ff", "#ff55ff", "#55ffff", "#ffffff",
+		},
+	},
+	"solarized": {
+		Foreground: "#839496", Background: "#002b36",
+		Palette: [16]string{
+			"#073642", "#dc322f", "#859900", "#b58900", "#268bd2", "#d33682", "#2aa198", "#eee8d5",
+			"#586e75", "#cb4b16", "#859900", "#b58900", "#268bd2", "#6c71c4", "#2aa198", "#fdf6e3",
+		},
+	},
+	"high-contrast": {
+		Foreground: "#ffffff", Background: "#000000",
+		Palette: [16]string{
+			"#000000", "#ff4040", "#40ff40", "#ffff00", "#6080ff", "#ff40ff", "#00ffff", "#ffffff",
+			"#909090", "#ff8080", "#80ff80", "#ffff80", "#a0c0ff", "#ff80ff", "#80ffff", "#ffffff",
+		},
+	},
+}
+
+//ThemeColors is what a theme draws with. A new one is made for every
+//switch and never changed, so the network goroutine can read it while
+//the main goroutine switches themes.
+type ThemeColors struct {
+	Palette [16]ANSIData //SGR 30-37, 90-97 and 256 color 0-15
+	FG      ANSIData
+	BG      color.RGBA
+}
+
+//Active colors, a *ThemeColors, empty until the first theme switch
+var themeColors atomic.Value
+
+var defaultColors = func() *ThemeColors {
+	pal, fg, bg, _ := builtinThemes[defaultThemeName].Colors()
+	return &ThemeColors{Palette: pal, FG: fg, BG: bg}
+}()
+
+var themeName = defaultThemeName
+var activeTheme = defaultThemeName
+
+//Host -> theme name, overrides themeName for that server
+var serverThemes map[string]string
+
+//Set from any goroutine, applied from Update
+var pendingTheme *Theme
+var themeLock sync.Mutex
+
+func init() {
+	for name, t := range builtinThemes {
+		t.Name = name
+	}
+
+	RegisterSetting(&Setting{
+		Name: "theme",
+		Help: "Color theme, see /theme for the list",
+		Get:  func() string { return themeName },
+		Set: func(val string) error {
+			t, err := FindTheme(val)
+			if err != nil {
+				return err
+			}
+			themeName = t.Name
+			SelectTheme(MainWin.serverAddr)
+			return nil
+		},
+	})
+	RegisterCommand(&Command{
+		Name: "theme",
+		Args: "[name [server]|default server]",
+		Help: "List color themes, or pick one for all servers or just this one",
+		Run:  cmdTheme,
+	})
+}
+
+//parseHexColor reads #rrggbb or #rgb
+func parseHexColor(s string) (color.RGBA, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	if len(s) != 6 {
+		return color.RGBA{}, fmt.Errorf("bad color %q, use #rrggbb", s)
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("bad color %q, use #rrggbb", s)
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xFF}, nil
+}
+
+//Colors parses a theme into its palette, default foreground and background
+func (t *Theme) Colors() ([16]ANSIData, ANSIData, color.RGBA, error) {
+	var pal [16]ANSIData
+	for i, s := range t.Palette {
+		c, err := parseHexColor(s)
+		if err != nil {
+			return pal, ANSIData{}, color.RGBA{}, fmt.Errorf("palette %d: %w", i, err)
+		}
+		pal[i] = ANSIData{Red: c.R, Green: c.G, Blue: c.B}
+	}
+
+	fg, err := parseHexColor(t.Foreground)
+	if err != nil {
+		return pal, ANSIData{}, color.RGBA{}, fmt.Errorf("foreground: %w", err)
+	}
+	bg, err := parseHexColor(t.Background)
+	if err != nil {
+		return pal, ANSIData{}, color.RGBA{}, fmt.Errorf("background: %w", err)
+	}
+	return pal, ANSIData{Red: fg.R, Green: fg.G, Blue: fg.B}, bg, nil
+}
+
+//ActiveColors is the palette and default colors of the current theme
+func ActiveColors() *ThemeColors {
+	if c, ok := themeColors.Load().(*ThemeColors); ok {
+		return c
+	}
+	return defaultColors
+}
+
+//FindTheme looks in the themes dir first, so built in themes can be overridden
+func FindTheme(name string) (*Theme, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || strings.ContainsAny(name, `/\.`) {
+		return nil, fmt.Errorf("bad theme name %q", name)
+	}
+
+	t := &Theme{}
+	err := LoadJSON(filepath.Join(themeDir, name+".json"), t)
+	if err == nil {
+		t.Name = name
+		if _, _, _, err := t.Colors(); err != nil {
+			return nil, fmt.Errorf("theme %s: %w", name, err)
+		}
+		return t, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("theme %s: %w", name, err)
+	}
+
+	if t, found := builtinThemes[name]; found {
+		return t, nil
+	}
+	return nil, fmt.Errorf("no theme named %s", name)
+}
+
+//ThemeNames lists built in themes and theme files
+func ThemeNames() []string {
+	found := map[string]bool{}
+	for name := range builtinThemes {
+		found[name] = true
+	}
+	files, _ := filepath.Glob(filepath.Join(ConfigPath(themeDir), "*.json"))
+	for _, file := range files {
+		found[strings.ToLower(strings.TrimSuffix(filepath.Base(file), ".json"))] = true
+	}
+
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func loadServerThemes() {
+	if serverThemes != nil {
+		return
+	}
+	serverThemes = map[string]string{}
+
+	err := LoadJSON(serverThemeFile, &serverThemes)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println("server themes:", err)
+	}
+}
+
+func saveServerThemes() {
+	err := SaveJSON(serverThemeFile, serverThemes)
+	if err != nil {
+		log.Println("server themes:", err)
+		AddLine(fmt.Sprintf("Unable to save server themes: %s\r\n", err))
+	}
+}
+
+//ServerTheme is the theme name to use for a server
+func ServerTheme(addr string) string {
+	host, _ := ParseServerAddr(addr)
+
+	themeLock.Lock()
+	defer themeLock.Unlock()
+	loadServerThemes()
+	if name, found := serverThemes[host]; found {
+		return name
+	}
+	return themeName
+}
+
+//SelectTheme switches to the theme for a server, the switch happens on the next update
+func SelectTheme(addr string) {
+	name := ServerTheme(addr)
+	t, err := FindTheme(name)
+	if err != nil {
+		AddLine(fmt.Sprintf("%s, using %s.\r\n", err, defaultThemeName))
+		t = builtinThemes[defaultThemeName]
+	}
+
+	themeLock.Lock()
+	pendingTheme = t
+	themeLock.Unlock()
+}
+
+//updateTheme applies a pending theme and redraws everything in its colors
+func updateTheme() {
+	themeLock.Lock()
+	t := pendingTheme
+	pendingTheme = nil
+	themeLock.Unlock()
+	if t == nil {
+		return
+	}
+
+	pal, fg, bg, err := t.Colors()
+	if err != nil {
+		AddLine(fmt.Sprintf("Theme %s: %s\r\n", t.Name, err))
+		return
+	}
+	themeColors.Store(&ThemeColors{Palette: pal, FG: fg, BG: bg})
+	activeTheme = t.Name
+
+	MainWin.lines.Recolor()
+	MainWin.input.dirty = true
+	renderText()
+}
+
+//Recolor looks up every stored color again, after the palette changes
+func (t *TextHistory) Recolor() {
+	t.rawTextLock.Lock()
+	if t.ansi != nil {
+		t.ansi.Recolor()
+	}
+	recolorAll(t.rawColors)
+	t.rawTextLock.Unlock()
+
+	if t.size == 0 {
+		return
+	}
+	for seq := t.tail; seq <= t.head; seq++ {
+		recolorAll(t.colors[seq%t.size])
+	}
+	t.ClearImages()
+	MainWin.viewChanged = true
+}
+
+func recolorAll(colors []ANSIData) {
+	for i := range colors {
+		if colors[i].Style&ANSI_STYLE_CONTROL == 0 {
+			colors[i] = resolveColor(colors[i])
+		}
+	}
+}
+
+func cmdTheme(args []string) error {
+	host, _ := ParseServerAddr(MainWin.serverAddr)
+
+	if len(args) == 0 {
+		buf := "Themes:\r\n"
+		for _, name := range ThemeNames() {
+			mark := " "
+			if name == activeTheme {
+				mark = "*"
+			}
+			buf += fmt.Sprintf(" %s %s\r\n", mark, name)
+		}
+		buf += fmt.Sprintf("Theme files go in %s\r\n", ConfigPath(themeDir))
+		AddLine(buf)
+		return nil
+	}
+
+	//Per-server choice
+	if len(args) > 1 {
+		if strings.ToLower(args[1]) != "server" {
+			return errors.New("use <name> [server]")
+		}
+		name := strings.ToLower(args[0])
+		if name != "default" {
+			t, err := FindTheme(name)
+			if err != nil {
+				return err
+			}
+			name = t.Name
+		}
+
+		themeLock.Lock()
+		loadServerThemes()
+		if name == "default" {
+			delete(serverThemes, host)
+		} else {
+			serverThemes[host] = name
+		}
+		saveServerThemes()
+		themeLock.Unlock()
+
+		SelectTheme(MainWin.serverAddr)
+		AddLine(fmt.Sprintf("Theme for %s: %s\r\n", host, ServerTheme(MainWin.serverAddr)))
+		return nil
+	}
+
+	return cmdSet([]string{"theme", args[0]})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+//TTYPE, terminal type (RFC 1091), with the MUD Terminal Type Standard
+const TELOPT_TTYPE = 24
+
+const TTYPE_IS = 0
+const TTYPE_SEND = 1
+
+//MTTS bits
+const MTTS_ANSI = 1
+const MTTS_VT100 = 2
+const MTTS_UTF8 = 4
+const MTTS_256_COLORS = 8
+const MTTS_MOUSE_TRACKING = 16
+const MTTS_OSC_COLOR_PALETTE = 32
+const MTTS_SCREEN_READER = 64
+const MTTS_PROXY = 128
+const MTTS_TRUECOLOR = 256
+const MTTS_MNES = 512
+const MTTS_MSLP = 1024
+const MTTS_SSL = 2048
+
+func init() {
+	RegisterTelnetOption(&TelnetOption{
+		Code:  TELOPT_TTYPE,
+		Name:  "TTYPE",
+		Local: true,
+		OnEnable: func(t *Telnet, local bool) {
+			t.lock.Lock()
+			t.ttypeCount = 0
+			t.lock.Unlock()
+		},
+		OnSub: ttypeSub,
+	})
+}
+
+//MTTSFlags is what we support, with the current settings
+func MTTSFlags(t *Telnet) int {
+	flags := MTTS_ANSI | MTTS_256_COLORS | MTTS_SSL
+	if t.Charset() == FindCharset("UTF-8") {
+		flags |= MTTS_UTF8
+	}
+	if trueColor {
+		flags |= MTTS_TRUECOLOR
+	}
+	return flags
+}
+
+//ttypeSub answers SEND with the client name, then the terminal, then MTTS.
+//The last one is repeated once to show the list has ended, then it starts over.
+func ttypeSub(t *Telnet, data []byte) {
+	if len(data) == 0 || data[0] != TTYPE_SEND {
+		return
+	}
+
+	types := []string{
+		strings.ToUpper(defaultWindowTitle) + " " + VersionString,
+		"XTERM-256COLOR",
+		fmt.Sprintf("MTTS %d", MTTSFlags(t)),
+	}
+
+	t.lock.Lock()
+	n := t.ttypeCount
+	t.ttypeCount++
+	if t.ttypeCount > len(types) {
+		t.ttypeCount = 0
+	}
+	t.lock.Unlock()
+
+	if n >= len(types) {
+		n = len(types) - 1
+	}
+	t.SendSub(TELOPT_TTYPE, append([]byte{TTYPE_IS}, types[n]...))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func ttypeIs(name string) string {
+	return iac(TELNET_SB, TELOPT_TTYPE) + raw(TTYPE_IS) + name + iac(TELNET_SE)
+}
+
+func TestTTYPECycle(t *testing.T) {
+	client := strings.ToUpper(defaultWindowTitle) + " " + VersionString
+	mtts := func(tn *Telnet) string { return fmt.Sprintf("MTTS %d", MTTSFlags(tn)) }
+	send := iac(TELNET_SB, TELOPT_TTYPE) + raw(TTYPE_SEND) + iac(TELNET_SE)
+
+	tn, out := newTestTelnet()
+	tn.local[TELOPT_TTYPE] = true
+
+	//The last one is repeated to mark the end, then it starts over
+	want := []string{client, "XTERM-256COLOR", mtts(tn), mtts(tn), client, "XTERM-256COLOR"}
+	for i, name := range want {
+		out.Reset()
+		tn.Process([]byte(send))
+		if out.String() != ttypeIs(name) {
+			t.Errorf("request %d: sent %q, want %q", i+1, out.Bytes(), ttypeIs(name))
+		}
+	}
+
+	//Anything but SEND is ignored
+	out.Reset()
+	tn.Process([]byte(iac(TELNET_SB, TELOPT_TTYPE) + raw(TTYPE_IS) + "xterm" + iac(TELNET_SE)))
+	if out.Len() != 0 {
+		t.Errorf("answered IS with %q", out.Bytes())
+	}
+
+	//A new connection starts at the client name
+	other, otherOut := newTestTelnet()
+	other.local[TELOPT_TTYPE] = true
+	other.Process([]byte(send))
+	if otherOut.String() != ttypeIs(client) {
+		t.Errorf("new connection sent %q", otherOut.Bytes())
+	}
+
+	//So does the same one after TTYPE is turned off and on
+	out.Reset()
+	tn.Process([]byte(iac(TELNET_DONT, TELOPT_TTYPE) + iac(TELNET_DO, TELOPT_TTYPE) + send))
+	want0 := iac(TELNET_WONT, TELOPT_TTYPE) + iac(TELNET_WILL, TELOPT_TTYPE) + ttypeIs(client)
+	if out.String() != want0 {
+		t.Errorf("after re-enable sent %q, want %q", out.Bytes(), want0)
+	}
+}
+
+func TestMTTSFlags(t *testing.T) {
+	defer func(old bool) { trueColor = old }(trueColor)
+
+	base := MTTS_ANSI | MTTS_256_COLORS | MTTS_SSL
+	tests := []struct {
+		charset   string
+		trueColor bool
+		want      int
+	}{
+		{"UTF-8", true, 2317}, //ANSI, UTF-8, 256 colors, truecolor and SSL
+		{"UTF-8", false, base | MTTS_UTF8},
+		{"ISO-8859-1", true, base | MTTS_TRUECOLOR},
+		{"IBM437", false, base},
+	}
+
+	for _, tc := range tests {
+		tn, _ := newTestTelnet()
+		tn.SetCharset(FindCharset(tc.charset))
+		trueColor = tc.trueColor
+
+		if got := MTTSFlags(tn); got != tc.want {
+			t.Errorf("%s truecolor %v: flags %d, want %d", tc.charset, tc.trueColor, got, tc.want)
+		}
+	}
+}
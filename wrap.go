@@ -0,0 +1,228 @@
+package main
+
+import (
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+var wordWrap = true
+var wrapIndent = 0
+
+func init() {
+	RegisterSetting(&Setting{
+		Name: "wrap",
+		Help: "Wrap long lines at word boundaries to fit the window",
+		Get:  func() string { return FormatBool(wordWrap) },
+		Set: func(val string) error {
+			if err := SetBool(&wordWrap, val); err != nil {
+				return err
+			}
+			MainWin.lines.Rewrap()
+			return nil
+		},
+	})
+	RegisterSetting(&Setting{
+		Name: "indent",
+		Help: "Columns to indent wrapped lines by (hanging indent)",
+		Get:  func() string { return strconv.Itoa(wrapIndent) },
+		Set: func(val string) error {
+			if err := SetInt(&wrapIndent, val, 0, MAX_WRAP_INDENT); err != nil {
+				return err
+			}
+			MainWin.lines.Rewrap()
+			return nil
+		},
+	})
+}
+
+//wrapCols is how many characters fit on one row, 0 if unknown
+func wrapCols() int {
+	if MainWin.realWidth <= 0 || MainWin.font.charWidth <= 0 {
+		return 0
+	}
+	//One column of margin on each side
+	cols := int(float64(MainWin.realWidth)/MainWin.font.charWidth) - 2
+	if cols < 1 {
+		cols = 1
+	}
+	return cols
+}
+
+//Zero width characters that join the one before them
+var zeroWidth = []*unicode.RangeTable{unicode.Mn, unicode.Me, unicode.Variation_Selector}
+
+//East Asian wide and fullwidth ranges, drawn two cells wide
+var wideRanges = [][2]rune{
+	{0x1100, 0x115F}, {0x231A, 0x231B}, {0x2329, 0x232A}, {0x23E9, 0x23EC},
+	{0x2E80, 0x303E}, {0x3041, 0x33FF}, {0x3400, 0x4DBF}, {0x4E00, 0x9FFF},
+	{0xA000, 0xA4CF}, {0xA960, 0xA97F}, {0xAC00, 0xD7A3}, {0xF900, 0xFAFF},
+	{0xFE10, 0xFE19}, {0xFE30, 0xFE6F}, {0xFF00, 0xFF60}, {0xFFE0, 0xFFE6},
+	{0x1F300, 0x1F64F}, {0x1F900, 0x1F9FF}, {0x20000, 0x2FFFD}, {0x30000, 0x3FFFD},
+}
+
+//runeWidth is how many cells a rune takes: 0, 1 or 2
+func runeWidth(r rune) int {
+	if r == 0x200D || unicode.IsOneOf(zeroWidth, r) {
+		return 0
+	}
+	if r < 0x1100 {
+		return 1
+	}
+	for _, w := range wideRanges {
+		if r < w[0] {
+			break
+		}
+		if r <= w[1] {
+			return 2
+		}
+	}
+	return 1
+}
+
+//nextCell measures the character starting at byte i, along with any
+//combining marks after it. Returns its length in bytes and width in cells,
+//the width is 0 for ANSI codes and control characters, which are not drawn.
+func nextCell(line string, colors []ANSIData, i int) (int, int) {
+	if i < len(colors) && colors[i] == ANSI_CONTROL {
+		return 1, 0
+	}
+
+	r, size := utf8.DecodeRuneInString(line[i:])
+	if r == utf8.RuneError && size <= 1 {
+		return 1, 1 //Drawn as the replacement character
+	}
+	if !unicode.IsPrint(r) {
+		return size, 0
+	}
+	width := runeWidth(r)
+	if width == 0 {
+		width = 1 //Nothing to combine with, give it its own cell
+	}
+
+	for i+size < len(line) {
+		next, n := utf8.DecodeRuneInString(line[i+size:])
+		if next == utf8.RuneError || runeWidth(next) != 0 {
+			break
+		}
+		if i+size < len(colors) && colors[i+size] == ANSI_CONTROL {
+			break
+		}
+		size += n
+	}
+	return size, width
+}
+
+//cellText is what to draw for a cell from nextCell
+func cellText(line string, i, size int) string {
+	s := line[i : i+size]
+	if !utf8.ValidString(s) {
+		return string(utf8.RuneError)
+	}
+	return s
+}
+
+//wrapLine returns the byte offsets where each display row of a line starts.
+//Colors are stored per byte, so they carry across rows without extra work.
+func wrapLine(line string, colors []ANSIData, cols, indent int) []int {
+	breaks := []int{0}
+	if !wordWrap || cols <= 0 {
+		return breaks
+	}
+	//Always leave room for some text after the indent
+	if indent > cols/2 {
+		indent = cols / 2
+	}
+
+	//Byte offsets and widths of the characters that take up a column
+	type cell struct {
+		pos   int
+		width int
+	}
+	cells := make([]cell, 0, len(line))
+	for i := 0; i < len(line); {
+		size, width := nextCell(line, colors, i)
+		if width > 0 {
+			cells = append(cells, cell{i, width})
+		}
+		i += size
+	}
+
+	start := 0
+	width := cols
+	for {
+		//First cell that doesn't fit on this row
+		end := start
+		used := 0
+		for end < len(cells) && used+cells[end].width <= width {
+			used += cells[end].width
+			end++
+		}
+		if end >= len(cells) {
+			break
+		}
+		if end == start {
+			end++ //Wider than the row, it goes on a row of its own
+		}
+
+		//Break at the last space that fits, or mid-word if there is none
+		brk := end
+		for k := end; k > start; k-- {
+			if k < len(cells) && line[cells[k].pos] == ' ' {
+				brk = k
+				break
+			}
+		}
+
+		//Spaces at the break are dropped
+		next := brk
+		for next < len(cells) && line[cells[next].pos] == ' ' {
+			next++
+		}
+		if next >= len(cells) {
+			break
+		}
+
+		breaks = append(breaks, cells[next].pos)
+		start = next
+		width = cols - indent
+	}
+	return breaks
+}
+
+//Rewrap recalculates the rows of every line, after a resize or font change
+func (t *TextHistory) Rewrap() {
+	if t.size == 0 {
+		return
+	}
+	cols := wrapCols()
+
+	t.rows = 0
+	for seq := t.tail; seq <= t.head; seq++ {
+		pos := seq % t.size
+		t.wraps[pos] = wrapLine(t.lines[pos], t.colors[pos], cols, wrapIndent)
+		t.rows += len(t.wraps[pos])
+	}
+	t.ClearImages()
+
+	//Wider rows or a smaller font, we may be scrolled past the top
+	if t == &MainWin.lines {
+		clampScroll()
+	}
+	MainWin.viewChanged = true
+}
+
+//LineRows is how many display rows a line takes
+func (t *TextHistory) LineRows(seq int) int {
+	if !t.Valid(seq) {
+		return 0
+	}
+	return len(t.wraps[seq%t.size])
+}
+
+func (t *TextHistory) Wraps(seq int) []int {
+	if !t.Valid(seq) {
+		return nil
+	}
+	return t.wraps[seq%t.size]
+}
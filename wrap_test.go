@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+//wrapRows splits a line at the offsets from wrapLine, escape codes removed
+func wrapRows(line string, colors []ANSIData, breaks []int) []string {
+	rows := []string{}
+	for i, start := range breaks {
+		end := len(line)
+		if i+1 < len(breaks) {
+			end = breaks[i+1]
+		}
+		rows = append(rows, PlainText(line[start:end], colors[start:end]))
+	}
+	return rows
+}
+
+func TestWrapLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		cols   int
+		indent int
+		want   []string
+	}{
+		{"empty", "", 10, 0, []string{""}},
+		{"fits", "hello", 10, 0, []string{"hello"}},
+		{"exact", "0123456789", 10, 0, []string{"0123456789"}},
+		{"at space", "hello big world", 10, 0, []string{"hello big ", "world"}},
+		{"spaces dropped", "hello     world", 8, 0, []string{"hello     ", "world"}},
+		{"long word", "abcdefghijklmnop", 6, 0, []string{"abcdef", "ghijkl", "mnop"}},
+		{"word after long word", "abcdefgh ij", 4, 0, []string{"abcd", "efgh ", "ij"}},
+		{"indent", "aaa bbb ccc ddd", 8, 2, []string{"aaa bbb ", "ccc ", "ddd"}},
+		{"indent capped", "aaaa bbbb cccc", 4, 10, []string{"aaaa ", "bb", "bb ", "cc", "cc"}},
+		{"no wrap", "hello big world", 0, 0, []string{"hello big world"}},
+		{"wide", "日本語日本語", 5, 0, []string{"日本", "語日", "本語"}},
+		{"wide even", "日本語日本語", 4, 0, []string{"日本", "語日", "本語"}},
+		{"wide wider than row", "日本", 1, 0, []string{"日", "本"}},
+		{"wide and narrow", "a日本語", 4, 0, []string{"a日", "本語"}},
+		{"combining", "e\u0301e\u0301e\u0301", 2, 0, []string{"e\u0301e\u0301", "e\u0301"}},
+		{"escapes take no room", "\033[31mred\033[0m \033[32mgreen\033[0m", 5, 0, []string{"red ", "green"}},
+		{"escape at break", "abc\033[1mdef", 3, 0, []string{"abc", "def"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			line, colors := NewANSIDecoder().Decode(tc.line)
+			got := wrapRows(line, colors, wrapLine(line, colors, tc.cols, tc.indent))
+			if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tc.want) {
+				t.Errorf("wrapLine(%q, %d) = %q, want %q", tc.line, tc.cols, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWrapLineOff(t *testing.T) {
+	wordWrap = false
+	defer func() { wordWrap = true }()
+
+	if got := wrapLine("hello big world", nil, 5, 0); len(got) != 1 {
+		t.Errorf("wrapped into %d rows with wrap off", len(got))
+	}
+}
+
+func TestRuneWidth(t *testing.T) {
+	tests := []struct {
+		r     rune
+		width int
+	}{
+		{'a', 1},
+		{'é', 1},
+		{'─', 1},
+		{'日', 2},
+		{'한', 2},
+		{'Ａ', 2},      //Fullwidth A
+		{'\u0301', 0}, //Combining acute
+		{'\u200d', 0}, //Zero width joiner
+	}
+
+	for _, tc := range tests {
+		if got := runeWidth(tc.r); got != tc.width {
+			t.Errorf("runeWidth(%q) = %d, want %d", tc.r, got, tc.width)
+		}
+	}
+}
+
+func TestRewrapClampsScroll(t *testing.T) {
+	defer func() {
+		MainWin.lines = TextHistory{}
+		MainWin.scroll, MainWin.newLines = 0, 0
+	}()
+
+	setWrapCols(t, 10)
+	MainWin.lines = TextHistory{}
+	MainWin.lines.Resize(5)
+	for _, line := range []string{"aaaa bbbb cccc", "dddd eeee ffff", "x"} {
+		MainWin.lines.Add(line, nil)
+	}
+	MainWin.scroll, MainWin.newLines = maxScroll(), 3
+
+	//Everything fits on one row each now
+	setWrapCols(t, 40)
+	MainWin.lines.Rewrap()
+	if MainWin.scroll != maxScroll() || MainWin.scroll != MainWin.lines.rows-visibleRows() {
+		t.Errorf("scroll %d after rewrap, max %d", MainWin.scroll, maxScroll())
+	}
+	if MainWin.newLines > MainWin.scroll {
+		t.Errorf("newLines %d past scroll %d", MainWin.newLines, MainWin.scroll)
+	}
+
+	//More rows again, the position is kept
+	before := MainWin.scroll
+	setWrapCols(t, 10)
+	MainWin.lines.Rewrap()
+	if MainWin.scroll != before {
+		t.Errorf("scroll moved from %d to %d with more rows", before, MainWin.scroll)
+	}
+}